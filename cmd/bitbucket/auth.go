@@ -0,0 +1,116 @@
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// DefaultTokenURL is the Bitbucket Cloud endpoint exchanging OAuth consumer credentials for an access token.
+const DefaultTokenURL = "https://bitbucket.org/site/oauth2/access_token"
+
+// credentials are used for both API calls and git operations.
+// Requests carry either a bearer token or basic auth with a username and password.
+type credentials struct {
+	username string
+	password string
+	token    string
+}
+
+// authenticate picks the authentication mode from the credentials configured in the source:
+//   - `token`, a repository/workspace access token on Cloud or an HTTP access token on Server
+//   - `username` and `app_password`, basic auth with an app password (or a password on Server)
+//   - `key` and `secret`, an OAuth consumer exchanged for an access token at `token_url`
+func (c *Client) authenticate(ctx context.Context) (credentials, error) {
+	source := c.source
+	modes := 0
+	for _, configured := range []bool{source.Token != "", source.AppPassword != "", source.Key != "" || source.Secret != ""} {
+		if configured {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return credentials{}, errors.New("only one of token, username/app_password or key/secret may be provided")
+	}
+
+	switch {
+	case source.Token != "":
+		return credentials{username: source.Username, token: source.Token}, nil
+	case source.AppPassword != "":
+		if source.Username == "" {
+			return credentials{}, errors.New("username must be provided with app_password")
+		}
+		return credentials{username: source.Username, password: source.AppPassword}, nil
+	case source.Key != "" || source.Secret != "":
+		token, err := c.requestToken(ctx)
+		if err != nil {
+			return credentials{}, err
+		}
+		return credentials{token: token}, nil
+	}
+	return credentials{}, errors.New("one of token, username/app_password or key/secret must be provided")
+}
+
+// GitCredentials returns the username and password to use when cloning over HTTPS.
+func (c *Client) GitCredentials() (string, string) {
+	return c.credentials.git()
+}
+
+func (a credentials) git() (string, string) {
+	if a.token == "" {
+		return a.username, a.password
+	}
+	if a.username != "" {
+		return a.username, a.token
+	}
+	return "x-token-auth", a.token
+}
+
+// authorize adds the credentials to an API request.
+func (a credentials) authorize(req *http.Request) {
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+		return
+	}
+	req.SetBasicAuth(a.username, a.password)
+}
+
+// requestToken exchanges the OAuth consumer key and secret for an access token using the client credentials grant.
+func (c *Client) requestToken(ctx context.Context) (string, error) {
+	source := c.source
+	if source.Key == "" {
+		return "", errors.New("key must be provided")
+	}
+	if source.Secret == "" {
+		return "", errors.New("secret must be provided")
+	}
+
+	tokenURL := source.TokenURL
+	if tokenURL == "" {
+		if source.Flavour == Server {
+			return "", errors.New("token_url must be provided to use OAuth with Bitbucket Server")
+		}
+		tokenURL = DefaultTokenURL
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	req, err := http.NewRequest("POST", tokenURL, bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create request object")
+	}
+	req.SetBasicAuth(source.Key, source.Secret)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	var response models.Token
+	err = c.do(req.WithContext(ctx), &response)
+	if err != nil {
+		return "", errors.Wrap(err, "request for token failed")
+	}
+	return response.AccessToken, nil
+}
@@ -1,316 +1,700 @@
 package bitbucket
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 
 	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
 )
 
-// SetBuildStatus updates the commit associated with a pull-request and sets the state () as well as a link to the Concourse build log.
-func SetBuildStatus(url, token, version, team, repo, commit, state, concourseHost string) error {
-	if url == "" {
-		return errors.New("url must be provided")
+// Flavours of Bitbucket supported by the resource, selected with `flavour` in the source.
+const (
+	Cloud  = "cloud"
+	Server = "server"
+)
+
+// Merge strategies accepted by MergePullRequest, named after their Bitbucket Cloud counterparts.
+const (
+	MergeStrategyMergeCommit = "merge_commit"
+	MergeStrategySquash      = "squash"
+	MergeStrategyFastForward = "fast_forward"
+)
+
+// StatusKeyPrefix starts the key of every build status set by the resource, followed by the job name.
+const StatusKeyPrefix = "concourse-"
+
+// validate checks the repository coordinates in source that every API call relies on.
+func validate(source models.Source) error {
+	if source.Flavour != "" && source.Flavour != Cloud && source.Flavour != Server {
+		return errors.Errorf("unknown flavour %q, must be one of %q or %q", source.Flavour, Cloud, Server)
 	}
-	if token == "" {
-		return errors.New("token must be provided")
+	if source.URL == "" {
+		return errors.New("url must be provided")
 	}
-	if version == "" {
+	if source.APIVersion == "" {
 		return errors.New("version must be provided")
 	}
-	if team == "" {
+	if source.Team == "" {
 		return errors.New("team must be provided")
 	}
-	if repo == "" {
+	if source.Repo == "" {
 		return errors.New("repo must be provided")
 	}
-	if commit == "" {
-		return errors.New("commit must be provided")
+	return nil
+}
+
+// pullRequestsURL returns the API endpoint listing the pull requests of the configured repository.
+func pullRequestsURL(source models.Source) string {
+	if source.Flavour == Server {
+		return source.URL + "/rest/api/" + source.APIVersion + "/projects/" + source.Team + "/repos/" + source.Repo + "/pull-requests"
 	}
-	if state == "" {
-		return errors.New("state must be provided")
+	return source.URL + "/" + source.APIVersion + "/repositories/" + source.Team + "/" + source.Repo + "/pullrequests"
+}
+
+// commitStatusesURL returns the API endpoint holding the build statuses of a commit.
+func commitStatusesURL(source models.Source, commit string) string {
+	if source.Flavour == Server {
+		return source.URL + "/rest/build-status/1.0/commits/" + commit
 	}
-	if concourseHost == "" {
-		return errors.New("concourse host must be provided")
+	return source.URL + "/" + source.APIVersion + "/repositories/" + source.Team + "/" + source.Repo + "/commit/" + commit + "/statuses"
+}
+
+// CloneURL returns the HTTPS URL of the configured repository. Credentials are provided separately, see GitCredentials.
+func (c *Client) CloneURL() (string, error) {
+	return c.RepositoryCloneURL(c.source.Team + "/" + c.source.Repo)
+}
+
+// RepositoryCloneURL returns the HTTPS URL of a repository given by its full name, such as the source repository
+// of a pull request from a fork.
+func (c *Client) RepositoryCloneURL(fullName string) (string, error) {
+	if c.source.Flavour != Server {
+		return "https://bitbucket.org/" + fullName, nil
+	}
+	u, err := url.Parse(c.source.URL)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse url %q", c.source.URL)
 	}
+	project, repo := path.Split(fullName)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/scm/" + strings.ToLower(project) + repo + ".git"
+	return u.String(), nil
+}
 
-	buildJob := os.Getenv("BUILD_JOB_NAME")
+// IsFork reports whether a pull request comes from another repository than the one it targets.
+func IsFork(pr models.GenericResponse) bool {
+	source, destination := pr.Source.Repository.FullName, pr.Destination.Repository.FullName
+	return source != "" && destination != "" && !strings.EqualFold(source, destination)
+}
 
-	concourseURL := fmt.Sprintf(
+// BuildURL returns the link to the running Concourse build, read from the build metadata environment variables.
+func BuildURL(concourseURL string) string {
+	return fmt.Sprintf(
 		"%s/teams/%s/pipelines/%s/jobs/%s/builds/%s",
-		concourseHost,
+		concourseURL,
 		os.Getenv("BUILD_TEAM_NAME"),
 		os.Getenv("BUILD_PIPELINE_NAME"),
-		buildJob,
+		os.Getenv("BUILD_JOB_NAME"),
 		os.Getenv("BUILD_NAME"),
 	)
+}
 
-	key := "concourse-" + buildJob
+// StatusKey returns the key of the build statuses set for the current job, unless overridden by params.
+func StatusKey(source models.Source) string {
+	if source.StatusKey != "" {
+		return source.StatusKey
+	}
+	return StatusKeyPrefix + os.Getenv("BUILD_JOB_NAME")
+}
 
-	status := models.OutStatus{State: state, Key: key, URL: concourseURL}
-	out, err := json.Marshal(status)
-	if err != nil {
-		return errors.Wrapf(err, "unable to marshal build status: %+v", status)
+// SetBuildStatus updates the commit associated with a pull-request and sets the state () as well as a link to the Concourse build log.
+// The key defaults to `status_key` from the source, or to one derived from the job name, and the URL to the build.
+func (c *Client) SetBuildStatus(ctx context.Context, commit string, status models.OutStatus) error {
+	if commit == "" {
+		return errors.New("commit must be provided")
+	}
+	if status.State == "" {
+		return errors.New("state must be provided")
+	}
+	if c.source.ConcourseURL == "" && status.URL == "" {
+		return errors.New("concourse host must be provided")
+	}
+
+	if status.Key == "" {
+		status.Key = StatusKey(c.source)
+	}
+	if status.URL == "" {
+		status.URL = BuildURL(c.source.ConcourseURL)
+	}
+	if c.source.Flavour == Server {
+		// The build status API of Bitbucket Server has no notion of the ref a commit was built from,
+		// nor of stopped builds.
+		status.Refname = ""
+		if status.State == "STOPPED" {
+			status.State = "FAILED"
+		}
+	}
+
+	endpoint := commitStatusesURL(c.source, commit) + "/build"
+	if c.source.Flavour == Server {
+		endpoint = commitStatusesURL(c.source, commit)
 	}
 
-	req, err := http.NewRequest("POST", url+"/"+version+"/repositories/"+team+"/"+repo+"/commit/"+commit+"/statuses/build", bytes.NewBuffer(out))
+	req, err := c.newRequest(ctx, "POST", endpoint, status)
 	if err != nil {
-		return errors.Wrap(err, "unable to create request object")
+		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Bearer "+token)
 
-	res, err := http.DefaultClient.Do(req)
+	err = c.do(req, nil)
 	if err != nil {
 		return errors.Wrap(err, "request to set build status failed")
 	}
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		buf := new(bytes.Buffer)
-		_, err = buf.ReadFrom(res.Body)
-		if err != nil {
-			return errors.Wrapf(err, "request to set build status failed with status [%d], but the response body could not be read", res.StatusCode)
-		}
-		return errors.Errorf("request to set build status failed, code [%d], url [%s], body: %s", res.StatusCode, req.URL, buf.String())
-	}
 	return nil
 }
 
 // GetPullRequests fetches the pull requests for a specific repository.
-func GetPullRequests(url string, token string, version string, team string, repo string) (*[]models.GenericResponse, error) {
-	if url == "" {
-		return nil, errors.New("url must be provided")
+func (c *Client) GetPullRequests(ctx context.Context) (*[]models.GenericResponse, error) {
+
+	req, err := c.newRequest(ctx, "GET", pullRequestsURL(c.source), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.source.Flavour == Server {
+		return c.getServerPullRequests(req)
+	}
+
+	response, err := c.doSlice(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve pull requests failed")
 	}
-	if token == "" {
-		return nil, errors.New("token must be provided")
+	return response, nil
+}
+
+// GetCommitStatuses retrieves every build status reported against a specific commit.
+func (c *Client) GetCommitStatuses(ctx context.Context, commit string) ([]models.CommitStatus, error) {
+	// Ref <https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/commit/%7Bnode%7D/statuses>
+
+	if commit == "" {
+		return nil, errors.New("commit must be provided")
 	}
-	if version == "" {
-		return nil, errors.New("version must be provided")
+
+	req, err := c.newRequest(ctx, "GET", commitStatusesURL(c.source, commit), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.source.Flavour == Server {
+		return c.getServerCommitStatuses(req)
 	}
-	if team == "" {
-		return nil, errors.New("team must be provided")
+
+	var statuses []models.CommitStatus
+	for {
+		var response models.CommitResponse
+		err = c.do(req, &response)
+		if IsNotFound(err) {
+			// Commits nobody has reported a status for yet may have no statuses resource at all.
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "request to retrieve commit statuses failed")
+		}
+		statuses = append(statuses, response.Values...)
+		if response.Next == "" {
+			break
+		}
+		req.URL, err = url.Parse(response.Next)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse next url")
+		}
 	}
-	if repo == "" {
-		return nil, errors.New("repo must be provided")
+	return statuses, nil
+}
+
+// GetPrComments returns the comments associated with a specific pullrequest.
+func (c *Client) GetPrComments(ctx context.Context, pr models.GenericResponse) (comments []models.Comment, err error) {
+	return c.comments(ctx, pr, false)
+}
+
+// GetInlineComments returns the comments attached to a line of a file of a specific pullrequest.
+func (c *Client) GetInlineComments(ctx context.Context, pr models.GenericResponse) (comments []models.Comment, err error) {
+	return c.comments(ctx, pr, true)
+}
+
+// comments returns either the top level or the inline comments of a pullrequest, skipping over replies.
+func (c *Client) comments(ctx context.Context, pr models.GenericResponse, inline bool) (comments []models.Comment, err error) {
+	// Ref https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/pullrequests/%7Bpull_request_id%7D/comments
+
+	if c.source.Flavour == Server {
+		return c.getServerComments(ctx, pr, inline)
 	}
 
-	req, err := http.NewRequest("GET", url+"/"+version+"/repositories/"+team+"/"+repo+"/pullrequests", nil)
+	req, err := c.newRequest(ctx, "GET", pr.Links.Comments.Href, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to create request object")
+		return comments, err
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
 
-	response, err := doSlice(req)
+	response, err := c.doSlice(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "request to retrieve pull requests failed")
+		return comments, errors.Wrap(err, "request to retrieve comments failed")
 	}
-	return response, nil
+
+	for _, commentRef := range *response {
+
+		if (commentRef.Inline != nil) != inline {
+			continue
+		}
+
+		if commentRef.Parent != nil {
+			// If its a reply to another comment, ignore it too.
+			continue
+		}
+
+		if commentRef.Deleted {
+			continue
+		}
+
+		comment := models.Comment{
+			ID:        commentRef.ID,
+			User:      commentRef.User,
+			Content:   commentRef.Content,
+			CreatedOn: commentRef.CreatedOn,
+			UpdatedOn: commentRef.UpdatedOn,
+			Link:      commentRef.Links.HTML.Href,
+		}
+		if commentRef.Inline != nil {
+			comment.Inline.Path = commentRef.Inline.Path
+			comment.Inline.To = commentRef.Inline.To
+		}
+		comments = append(comments, comment)
+	}
+	return comments, nil
 }
 
-// GetCommitStatus retrieves the current commit status for a specific commit, referenced by URL.
-func GetCommitStatus(url string, token string) (string, error) {
-	// Ref <https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/pullrequests/%7Bpull_request_id%7D/statuses>
+// CreateComment posts a new top level comment on a pullrequest.
+func (c *Client) CreateComment(ctx context.Context, pr models.GenericResponse, text string) (*models.Comment, error) {
+	// Ref https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/pullrequests/%7Bpull_request_id%7D/comments#post
 
-	if url == "" {
-		return "", errors.New("url must be provided")
+	if text == "" {
+		return nil, errors.New("comment text must be provided")
 	}
-	if token == "" {
-		return "", errors.New("token must be provided")
+
+	if c.source.Flavour == Server {
+		return c.createServerComment(ctx, pr, text)
 	}
 
-	req, err := http.NewRequest("GET", url+"/statuses", nil)
+	body := map[string]interface{}{"content": map[string]string{"raw": text}}
+	req, err := c.newRequest(ctx, "POST", pullRequestsURL(c.source)+"/"+strconv.Itoa(pr.ID)+"/comments", body)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to create request")
+		return nil, err
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
 
-	var response models.CommitResponse
-	err = do(req, &response)
+	response, err := c.doObject(req)
 	if err != nil {
-		return "", errors.Wrap(err, "request to retrieve commit status failed")
+		return nil, errors.Wrap(err, "request to create comment failed")
+	}
+	return &models.Comment{
+		ID:        response.ID,
+		User:      response.User,
+		Content:   response.Content,
+		CreatedOn: response.CreatedOn,
+		UpdatedOn: response.UpdatedOn,
+		Link:      response.Links.HTML.Href,
+	}, nil
+}
+
+// CreateInlineComment posts a new comment on a line of a file changed by a pullrequest.
+func (c *Client) CreateInlineComment(ctx context.Context, pr models.GenericResponse, path string, line int, text string) (*models.Comment, error) {
+	if text == "" {
+		return nil, errors.New("comment text must be provided")
 	}
-	if len(response.Values) > 0 {
-		return response.Values[0].State, nil
+	if path == "" {
+		return nil, errors.New("comment path must be provided")
 	}
-	return "none", nil
+
+	if c.source.Flavour == Server {
+		return c.createServerInlineComment(ctx, pr, path, line, text)
+	}
+
+	inline := map[string]interface{}{"path": path}
+	if line > 0 {
+		inline["to"] = line
+	}
+	body := map[string]interface{}{"content": map[string]string{"raw": text}, "inline": inline}
+	req, err := c.newRequest(ctx, "POST", pullRequestsURL(c.source)+"/"+strconv.Itoa(pr.ID)+"/comments", body)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.doObject(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to create inline comment failed")
+	}
+	return &models.Comment{
+		ID:        response.ID,
+		User:      response.User,
+		Content:   response.Content,
+		CreatedOn: response.CreatedOn,
+		UpdatedOn: response.UpdatedOn,
+		Link:      response.Links.HTML.Href,
+	}, nil
 }
 
-// GetPrComments returns the comments associated with a specific pullrequest, referenced by URL.
-func GetPrComments(url string, token string) (comments []models.Comment, err error) {
-	// Ref https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/pullrequests/%7Bpull_request_id%7D/comments
+// UpdateComment replaces the text of an existing comment on a pullrequest.
+func (c *Client) UpdateComment(ctx context.Context, pr models.GenericResponse, comment models.Comment, text string) (*models.Comment, error) {
+	if text == "" {
+		return nil, errors.New("comment text must be provided")
+	}
 
-	if url == "" {
-		return comments, errors.New("url must be provided")
+	if c.source.Flavour == Server {
+		return c.updateServerComment(ctx, pr, comment, text)
 	}
-	if token == "" {
-		return comments, errors.New("token must be provided")
+
+	body := map[string]interface{}{"content": map[string]string{"raw": text}}
+	req, err := c.newRequest(ctx, "PUT", commentURL(c.source, pr, comment), body)
+	if err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	response, err := c.doObject(req)
 	if err != nil {
-		return comments, errors.Wrap(err, "unable to create request")
+		return nil, errors.Wrap(err, "request to update comment failed")
+	}
+	return &models.Comment{
+		ID:        response.ID,
+		User:      response.User,
+		Content:   response.Content,
+		CreatedOn: response.CreatedOn,
+		UpdatedOn: response.UpdatedOn,
+		Link:      response.Links.HTML.Href,
+	}, nil
+}
+
+// DeleteComment removes a comment from a pullrequest.
+func (c *Client) DeleteComment(ctx context.Context, pr models.GenericResponse, comment models.Comment) error {
+	endpoint := commentURL(c.source, pr, comment)
+	if c.source.Flavour == Server {
+		endpoint += "?version=" + strconv.Itoa(comment.Version)
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
 
-	var response models.PagedGenericResponse
-	err = do(req, &response)
+	req, err := c.newRequest(ctx, "DELETE", endpoint, nil)
 	if err != nil {
-		return comments, errors.Wrap(err, "request to retrieve commit status failed")
+		return err
 	}
 
-	if len(response.Values) > 0 {
+	err = c.do(req, nil)
+	if err != nil {
+		return errors.Wrap(err, "request to delete comment failed")
+	}
+	return nil
+}
 
-		for _, commentRef := range response.Values {
+// commentURL returns the API endpoint of a single pullrequest comment.
+func commentURL(source models.Source, pr models.GenericResponse, comment models.Comment) string {
+	return pullRequestsURL(source) + "/" + strconv.Itoa(pr.ID) + "/comments/" + strconv.Itoa(comment.ID)
+}
 
-			if commentRef.Inline != nil {
-				// skip over inline comments
-				continue
-			}
+// GetChangedPaths returns every path touched by a pullrequest.
+// Renamed files contribute both their old and new path.
+func (c *Client) GetChangedPaths(ctx context.Context, pr models.GenericResponse) ([]string, error) {
+	// Ref https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/diffstat/%7Bspec%7D
 
-			if commentRef.Parent != nil {
-				// If its a reply to another comment, ignore it too.
-				continue
-			}
+	if c.source.Flavour == Server {
+		return c.getServerChangedPaths(ctx, pr)
+	}
 
-			comments = append(comments, models.Comment{
-				User:      commentRef.User,
-				Content:   commentRef.Content,
-				CreatedOn: commentRef.CreatedOn,
-				Link:      commentRef.Links.HTML.Href,
-			})
+	req, err := c.newRequest(ctx, "GET", diffstatLink(pr), nil)
+	if err != nil {
+		return nil, err
+	}
 
-		}
+	response, err := c.doSlice(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve diffstat failed")
+	}
 
+	var paths []string
+	for _, file := range *response {
+		if file.Old != nil && file.Old.Path != "" {
+			paths = append(paths, file.Old.Path)
+		}
+		if file.New != nil && file.New.Path != "" && (file.Old == nil || file.New.Path != file.Old.Path) {
+			paths = append(paths, file.New.Path)
+		}
 	}
-	return comments, nil
+	return paths, nil
 }
 
-func GetPullRequestByID(url string, token string, version string, team string, repo string, request string) (*models.GenericResponse, error) {
-	if url == "" {
-		return nil, errors.New("url must be provided")
+// diffstatLink returns the diffstat endpoint of a pull request. Older API responses
+// only carry the diff link, which lives right next to it.
+func diffstatLink(pr models.GenericResponse) string {
+	if pr.Links.Diffstat.Href != "" {
+		return pr.Links.Diffstat.Href
 	}
-	if token == "" {
-		return nil, errors.New("token must be provided")
+	return strings.TrimSuffix(pr.Links.Diff.Href, "/diff") + "/diffstat"
+}
+
+func (c *Client) GetPullRequestByID(ctx context.Context, request string) (*models.GenericResponse, error) {
+	if request == "" {
+		return nil, errors.New("PR id must be provided")
 	}
-	if version == "" {
-		return nil, errors.New("version must be provided")
+
+	req, err := c.newRequest(ctx, "GET", pullRequestsURL(c.source)+"/"+request, nil)
+	if err != nil {
+		return nil, err
 	}
-	if team == "" {
-		return nil, errors.New("team must be provided")
+
+	if c.source.Flavour == Server {
+		return c.getServerPullRequest(req)
 	}
-	if repo == "" {
-		return nil, errors.New("repo must be provided")
+
+	response, err := c.doObject(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve pull request failed")
 	}
+	return response, nil
+}
+
+func (c *Client) ApprovePullRequest(ctx context.Context, request string) (*models.GenericResponse, error) {
 	if request == "" {
 		return nil, errors.New("PR id must be provided")
 	}
 
-	req, err := http.NewRequest("GET", url+"/"+version+"/repositories/"+team+"/"+repo+"/pullrequests/"+request, nil)
+	req, err := c.newRequest(ctx, "POST", pullRequestsURL(c.source)+"/"+request+"/approve", nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to create request object")
+		return nil, err
+	}
+
+	if c.source.Flavour == Server {
+		return c.approveServerPullRequest(req)
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
 
-	response, err := doObject(req)
+	response, err := c.doObject(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "request to retrieve pull request failed")
+		return nil, errors.Wrap(err, "request to approve pull request failed")
 	}
 	return response, nil
 }
 
-func ApprovePullRequest(url string, token string, version string, team string, repo string, request string) (*models.GenericResponse, error) {
-	if url == "" {
-		return nil, errors.New("url must be provided")
+// GetSourceCommit fetches the head commit of the source branch of a pullrequest.
+func (c *Client) GetSourceCommit(ctx context.Context, pr models.GenericResponse) (*models.Commit, error) {
+	// Ref https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/commit/%7Bnode%7D
+
+	if pr.Source.Commit.Hash == "" {
+		return nil, errors.New("commit must be provided")
 	}
-	if token == "" {
-		return nil, errors.New("token must be provided")
+
+	if c.source.Flavour == Server {
+		return c.getServerCommit(ctx, pr.Source.Commit.Hash)
 	}
-	if version == "" {
-		return nil, errors.New("version must be provided")
+
+	// The link points at the repository holding the commit, which is the fork for pull requests from forks.
+	endpoint := pr.Source.Commit.Links.Self.Href
+	if endpoint == "" {
+		endpoint = c.source.URL + "/" + c.source.APIVersion + "/repositories/" + c.source.Team + "/" + c.source.Repo + "/commit/" + pr.Source.Commit.Hash
 	}
-	if team == "" {
-		return nil, errors.New("team must be provided")
+	req, err := c.newRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
 	}
-	if repo == "" {
-		return nil, errors.New("repo must be provided")
+
+	var commit models.Commit
+	err = c.do(req, &commit)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve commit failed")
 	}
-	if request == "" {
-		return nil, errors.New("PR id must be provided")
+	return &commit, nil
+}
+
+// GetApprovers returns the users whose approval of a pullrequest applies to its current source commit, as opposed
+// to approvals given before the latest push.
+func (c *Client) GetApprovers(ctx context.Context, pr models.GenericResponse) ([]models.Author, error) {
+	// Ref https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/pullrequests/%7Bpull_request_id%7D/activity
+
+	head := pr.Source.Commit.Hash
+	var approvers []models.Author
+	if c.source.Flavour == Server {
+		for _, participant := range pr.Participants {
+			if participant.Approved && participant.LastReviewedCommit != "" && sameCommit(participant.LastReviewedCommit, head) {
+				approvers = append(approvers, participant.User)
+			}
+		}
+		return approvers, nil
 	}
 
-	req, err := http.NewRequest("POST", url+"/"+version+"/repositories/"+team+"/"+repo+"/pullrequests/"+request+"/approve", nil)
+	endpoint := pr.Links.Activity.Href
+	if endpoint == "" {
+		endpoint = pullRequestsURL(c.source) + "/" + strconv.Itoa(pr.ID) + "/activity"
+	}
+	req, err := c.newRequest(ctx, "GET", endpoint, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to create request object")
+		return nil, err
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
 
-	response, err := doObject(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "request to approve pull request failed")
+	// The activity log is newest first. Approvals are pending until an older update with the head commit shows
+	// they were given after it was pushed, and pending ones are dropped at the update that pushed another commit.
+	approvedAfterPush := map[string]bool{}
+	pending := map[string]bool{}
+	for done := false; !done; {
+		var response struct {
+			Values []models.Activity `json:"values"`
+			Next   string            `json:"next"`
+		}
+		err = c.do(req, &response)
+		if err != nil {
+			return nil, errors.Wrap(err, "request to retrieve pull request activity failed")
+		}
+		for _, activity := range response.Values {
+			if activity.Update != nil {
+				if !sameCommit(activity.Update.Source.Commit.Hash, head) {
+					done = true
+					break
+				}
+				for uuid := range pending {
+					approvedAfterPush[uuid] = true
+				}
+				pending = map[string]bool{}
+			}
+			if activity.Approval != nil {
+				pending[activity.Approval.User.UUID] = true
+			}
+		}
+		if done || response.Next == "" {
+			break
+		}
+		req.URL, err = url.Parse(response.Next)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse next url")
+		}
 	}
-	return response, nil
+
+	// Withdrawn approvals stay in the activity log, whereas participants tell whether they still stand.
+	for _, participant := range pr.Participants {
+		if participant.Approved && approvedAfterPush[participant.User.UUID] {
+			approvers = append(approvers, participant.User)
+		}
+	}
+	return approvers, nil
 }
 
-func DeclinePullRequest(url string, token string, version string, team string, repo string, request string) (*models.GenericResponse, error) {
-	if url == "" {
-		return nil, errors.New("url must be provided")
+// sameCommit compares commit hashes, either of which may be abbreviated.
+func sameCommit(a, b string) bool {
+	if a == "" || b == "" {
+		return false
 	}
-	if token == "" {
-		return nil, errors.New("token must be provided")
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// UnapprovePullRequest withdraws the approval of the configured user from a pullrequest.
+func (c *Client) UnapprovePullRequest(ctx context.Context, request string) error {
+	if request == "" {
+		return errors.New("PR id must be provided")
 	}
-	if version == "" {
-		return nil, errors.New("version must be provided")
+
+	if c.source.Flavour == Server {
+		return c.setServerParticipantStatus(ctx, request, "UNAPPROVED")
 	}
-	if team == "" {
-		return nil, errors.New("team must be provided")
+
+	req, err := c.newRequest(ctx, "DELETE", pullRequestsURL(c.source)+"/"+request+"/approve", nil)
+	if err != nil {
+		return err
 	}
-	if repo == "" {
-		return nil, errors.New("repo must be provided")
+
+	err = c.do(req, nil)
+	if err != nil {
+		return errors.Wrap(err, "request to unapprove pull request failed")
 	}
+	return nil
+}
+
+// RequestChanges marks a pullrequest as needing work on behalf of the configured user.
+func (c *Client) RequestChanges(ctx context.Context, request string) error {
 	if request == "" {
-		return nil, errors.New("PR id must be provided")
+		return errors.New("PR id must be provided")
 	}
 
-	req, err := http.NewRequest("POST", url+"/"+version+"/repositories/"+team+"/"+repo+"/pullrequests/"+request+"/decline", nil)
+	if c.source.Flavour == Server {
+		return c.setServerParticipantStatus(ctx, request, "NEEDS_WORK")
+	}
+
+	req, err := c.newRequest(ctx, "POST", pullRequestsURL(c.source)+"/"+request+"/request-changes", nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to create request object")
+		return err
 	}
-	req.Header.Add("Authorization", "Bearer "+token)
 
-	response, err := doObject(req)
+	err = c.do(req, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "request to decline pull request failed")
+		return errors.Wrap(err, "request to request changes on pull request failed")
+	}
+	return nil
+}
+
+// MergePullRequest merges a pullrequest with the given strategy, the default strategy of the repository when empty.
+// An empty message lets Bitbucket generate the commit message.
+func (c *Client) MergePullRequest(ctx context.Context, pr models.GenericResponse, strategy, message string, closeSourceBranch bool) (*models.GenericResponse, error) {
+	// Ref https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/pullrequests/%7Bpull_request_id%7D/merge
+
+	switch strategy {
+	case "", MergeStrategyMergeCommit, MergeStrategySquash, MergeStrategyFastForward:
+	default:
+		return nil, errors.Errorf("unknown merge strategy %q, must be one of %q, %q or %q",
+			strategy, MergeStrategyMergeCommit, MergeStrategySquash, MergeStrategyFastForward)
+	}
+
+	if c.source.Flavour == Server {
+		return c.mergeServerPullRequest(ctx, pr, strategy, message, closeSourceBranch)
+	}
+
+	endpoint := pr.Links.Merge.Href
+	if endpoint == "" {
+		endpoint = pullRequestsURL(c.source) + "/" + strconv.Itoa(pr.ID) + "/merge"
+	}
+
+	body := map[string]interface{}{
+		"type":                "pullrequest",
+		"close_source_branch": closeSourceBranch,
+	}
+	if strategy != "" {
+		body["merge_strategy"] = strategy
+	}
+	if message != "" {
+		body["message"] = message
+	}
+	req, err := c.newRequest(ctx, "POST", endpoint, body)
+	if err != nil {
+		return nil, err
 	}
 
+	response, err := c.doObject(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to merge pull request failed")
+	}
 	return response, nil
 }
 
-func RequestToken(key string, secret string) (string, error) {
-	if key == "" {
-		return "", errors.New("key must be provided")
+func (c *Client) DeclinePullRequest(ctx context.Context, request string) (*models.GenericResponse, error) {
+	if request == "" {
+		return nil, errors.New("PR id must be provided")
 	}
-	if secret == "" {
-		return "", errors.New("secret must be provided")
+
+	if c.source.Flavour == Server {
+		return c.declineServerPullRequest(ctx, request)
 	}
 
-	data := url.Values{}
-	data.Set("grant_type", "client_credentials")
-	req, err := http.NewRequest("POST", "https://bitbucket.org/site/oauth2/access_token", bytes.NewBufferString(data.Encode()))
+	req, err := c.newRequest(ctx, "POST", pullRequestsURL(c.source)+"/"+request+"/decline", nil)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to create request object")
+		return nil, err
 	}
-	req.SetBasicAuth(key, secret)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	var response models.Token
-	err = do(req, &response)
+	response, err := c.doObject(req)
 	if err != nil {
-		return "", errors.Wrap(err, "request for token failed")
+		return nil, errors.Wrap(err, "request to decline pull request failed")
 	}
-	return response.AccessToken, nil
+
+	return response, nil
 }
@@ -0,0 +1,147 @@
+package bitbucket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+func update(hash string) string {
+	return fmt.Sprintf(`{"update": {"source": {"commit": {"hash": %q}}}}`, hash)
+}
+
+func approval(uuid string) string {
+	return fmt.Sprintf(`{"approval": {"user": {"uuid": %q}}}`, uuid)
+}
+
+func TestGetApprovers(t *testing.T) {
+	tests := []struct {
+		name     string
+		pages    [][]string
+		approved []string
+		want     []string
+	}{
+		{
+			name:     "approval after the push",
+			pages:    [][]string{{approval("A"), update("new111"), update("old000")}},
+			approved: []string{"A"},
+			want:     []string{"A"},
+		},
+		{
+			name:     "approval of the previous commit",
+			pages:    [][]string{{update("new111"), approval("B"), update("old000")}},
+			approved: []string{"B"},
+			want:     nil,
+		},
+		{
+			name:     "approval between two updates of the head commit",
+			pages:    [][]string{{update("new111"), approval("A"), update("new111"), approval("B"), update("old000")}},
+			approved: []string{"A", "B"},
+			want:     []string{"A"},
+		},
+		{
+			name:     "withdrawn approval",
+			pages:    [][]string{{approval("A"), update("new111")}},
+			approved: nil,
+			want:     nil,
+		},
+		{
+			name:     "no update with the head commit",
+			pages:    [][]string{{approval("A")}},
+			approved: []string{"A"},
+			want:     nil,
+		},
+		{
+			name:     "across pages",
+			pages:    [][]string{{approval("A"), approval("B")}, {update("new111a2b3c"), update("old000")}},
+			approved: []string{"A", "B"},
+			want:     []string{"A", "B"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var page int
+				fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+				next := ""
+				if page+1 < len(test.pages) {
+					next = fmt.Sprintf("%s/activity?page=%d", server.URL, page+1)
+				}
+				fmt.Fprintf(w, `{"values": [%s], "next": %q}`, strings.Join(test.pages[page], ","), next)
+			}))
+			defer server.Close()
+
+			pr := models.GenericResponse{ID: 1}
+			pr.Source.Commit.Hash = "new111"
+			pr.Links.Activity.Href = server.URL + "/activity"
+			for _, uuid := range []string{"A", "B"} {
+				participant := models.Participant{User: models.Author{UUID: uuid}}
+				for _, approved := range test.approved {
+					participant.Approved = participant.Approved || approved == uuid
+				}
+				pr.Participants = append(pr.Participants, participant)
+			}
+
+			c := &Client{source: models.Source{Flavour: Cloud}, httpClient: http.DefaultClient}
+			approvers, err := c.GetApprovers(context.Background(), pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, approver := range approvers {
+				got = append(got, approver.UUID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got approvers %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetApproversServer(t *testing.T) {
+	pr := models.GenericResponse{ID: 1}
+	pr.Source.Commit.Hash = "new111"
+	pr.Participants = []models.Participant{
+		{Approved: true, LastReviewedCommit: "new111", User: models.Author{Username: "current"}},
+		{Approved: true, LastReviewedCommit: "old000", User: models.Author{Username: "outdated"}},
+		{Approved: false, LastReviewedCommit: "new111", User: models.Author{Username: "unapproved"}},
+	}
+
+	c := &Client{source: models.Source{Flavour: Server}}
+	approvers, err := c.GetApprovers(context.Background(), pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(approvers) != 1 || approvers[0].Username != "current" {
+		t.Errorf("got approvers %+v, want only current", approvers)
+	}
+}
+
+func TestRepositoryCloneURL(t *testing.T) {
+	tests := []struct {
+		source   models.Source
+		fullName string
+		want     string
+	}{
+		{source: models.Source{Flavour: Cloud}, fullName: "someone/repo", want: "https://bitbucket.org/someone/repo"},
+		{source: models.Source{Flavour: Server, URL: "https://git.example.com/bitbucket/"}, fullName: "PROJ/repo", want: "https://git.example.com/bitbucket/scm/proj/repo.git"},
+		{source: models.Source{Flavour: Server, URL: "https://git.example.com"}, fullName: "~SOMEONE/repo", want: "https://git.example.com/scm/~someone/repo.git"},
+	}
+	for _, test := range tests {
+		c := &Client{source: test.source}
+		got, err := c.RepositoryCloneURL(test.fullName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+}
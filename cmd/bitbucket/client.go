@@ -2,33 +2,153 @@ package bitbucket
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
-	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
 	"github.com/pkg/errors"
-	"github.com/sethgrid/pester"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
 )
 
+const (
+	// DefaultTimeout bounds the API calls of a check, in or out run when the source does not set `timeout`.
+	DefaultTimeout = 5 * time.Minute
+	// DefaultMaxRetries is the number of retries of a failed request when the source does not set `max_retries`.
+	DefaultMaxRetries = 10
+	// DefaultMaxBackoff caps the delay between two retries when the source does not set `max_backoff`.
+	DefaultMaxBackoff = 30 * time.Second
+	// DefaultRetryBudget bounds the total time spent waiting between retries of a single request when the
+	// source does not set `retry_budget`.
+	DefaultRetryBudget = 2 * time.Minute
+
+	// attemptTimeout bounds a single HTTP request, the overall deadline comes from the request context.
+	attemptTimeout = time.Minute
+)
+
+// Client talks to the Bitbucket API on behalf of the repository configured in a source.
+// It is built once per run and shares a single connection pool between all requests.
+type Client struct {
+	source      models.Source
+	credentials credentials
+	httpClient  *http.Client
+
+	maxRetries  int
+	maxBackoff  time.Duration
+	retryBudget time.Duration
+}
+
+// NewClient validates source and authenticates against Bitbucket with the credentials it holds.
+func NewClient(ctx context.Context, source models.Source) (*Client, error) {
+	if err := validate(source); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		source:      source,
+		maxRetries:  DefaultMaxRetries,
+		maxBackoff:  DefaultMaxBackoff,
+		retryBudget: DefaultRetryBudget,
+		httpClient: &http.Client{
+			Timeout: attemptTimeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConns:          10,
+				MaxIdleConnsPerHost:   10,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: time.Second,
+			},
+		},
+	}
+
+	if source.MaxRetries != nil {
+		if *source.MaxRetries < 0 {
+			return nil, errors.Errorf("invalid max_retries %d, must not be negative", *source.MaxRetries)
+		}
+		c.maxRetries = *source.MaxRetries
+	}
+	var err error
+	if source.MaxBackoff != "" {
+		if c.maxBackoff, err = time.ParseDuration(source.MaxBackoff); err != nil {
+			return nil, errors.Wrapf(err, "invalid max_backoff %q", source.MaxBackoff)
+		}
+	}
+	if source.RetryBudget != "" {
+		if c.retryBudget, err = time.ParseDuration(source.RetryBudget); err != nil {
+			return nil, errors.Wrapf(err, "invalid retry_budget %q", source.RetryBudget)
+		}
+	}
+
+	credentials, err := c.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.credentials = credentials
+	return c, nil
+}
+
+// Timeout returns the overall deadline of a run, as configured with `timeout` in the source.
+func Timeout(source models.Source) (time.Duration, error) {
+	if source.Timeout == "" {
+		return DefaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(source.Timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid timeout %q", source.Timeout)
+	}
+	return timeout, nil
+}
+
+// newRequest creates an authorized API request bound to ctx. A non-nil body is sent as JSON.
+func (c *Client) newRequest(ctx context.Context, method, endpoint string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		out, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to marshal request body: %+v", body)
+		}
+		reader = bytes.NewReader(out)
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create request object")
+	}
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	c.credentials.authorize(req)
+	return req.WithContext(ctx), nil
+}
+
 // doObject will request and return a GenericResponse
-func doObject(request *http.Request) (*models.GenericResponse, error) {
+func (c *Client) doObject(request *http.Request) (*models.GenericResponse, error) {
 	var response models.GenericResponse
-	err := do(request, &response)
+	err := c.do(request, &response)
 	return &response, err
 }
 
 // doSlice will iterate over PagedGenericResponses to return a slice of GenericResponses
-func doSlice(request *http.Request) (*[]models.GenericResponse, error) {
+func (c *Client) doSlice(request *http.Request) (*[]models.GenericResponse, error) {
 	var values []models.GenericResponse
 	for {
 		var response models.PagedGenericResponse
-		err := do(request, &response)
+		err := c.do(request, &response)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to retrieve values")
 		}
 		values = append(values, response.Values...)
-		// fmt.Printf("values: %+v size: %+v page: %+v pagelen: %+v next: %+v\n", len(values), response.Size, response.Page, response.Pagelen, response.Next)
 		if response.Next == "" {
 			break
 		}
@@ -41,20 +161,11 @@ func doSlice(request *http.Request) (*[]models.GenericResponse, error) {
 }
 
 // do will perform a http request with retries and backoff
-// will then unmarshall into the passed response object
-func do(request *http.Request, response interface{}) error {
-	client := pester.New()
-	client.MaxRetries = 10
-	client.Backoff = pester.ExponentialBackoff
-	client.KeepLog = true
-	resp, err := client.Do(request)
+// will then unmarshall into the passed response object, unless it is nil
+func (c *Client) do(request *http.Request, response interface{}) error {
+	resp, err := c.send(request)
 	if err != nil {
-		return errors.Wrap(err, client.LogString())
-	}
-
-	// Some Bitbucket APIs can return 404 in some cases.
-	if resp.StatusCode == 404 {
-		return nil
+		return err
 	}
 
 	defer resp.Body.Close()
@@ -64,7 +175,10 @@ func do(request *http.Request, response interface{}) error {
 		return errors.Wrap(err, "unable to read response body")
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return errors.Errorf("request failed, code [%d], url [%s], body: %s", resp.StatusCode, request.URL, buf.String())
+		return newAPIError(resp.StatusCode, request.URL.String(), buf.Bytes())
+	}
+	if response == nil || buf.Len() == 0 {
+		return nil
 	}
 	err = json.Unmarshal(buf.Bytes(), &response)
 	if err != nil {
@@ -72,3 +186,105 @@ func do(request *http.Request, response interface{}) error {
 	}
 	return nil
 }
+
+// send performs a request, retrying with exponential backoff on network errors, rate limiting and server side
+// failures until it succeeds, the retries or the retry budget run out, or the request context is done.
+// When Bitbucket says how long to wait, through Retry-After or X-RateLimit-Reset, that delay is used instead.
+func (c *Client) send(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to rewind request body")
+			}
+			request.Body = body
+		}
+
+		resp, err := c.httpClient.Do(request)
+		if err == nil && resp.Header.Get("X-RateLimit-NearLimit") == "true" {
+			log.Printf("approaching the Bitbucket rate limit for %s", resp.Header.Get("X-RateLimit-Resource"))
+		}
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, errors.Wrapf(ctx.Err(), "request to [%s %s] did not complete in time", request.Method, request.URL)
+		}
+
+		delay := backoff(attempt, c.maxBackoff)
+		var rateLimited *RateLimitError
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok {
+				delay = after
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				rateLimited = &RateLimitError{URL: request.URL.String(), RetryAfter: delay}
+			}
+		}
+
+		deadline, hasDeadline := ctx.Deadline()
+		if attempt >= c.maxRetries || waited+delay > c.retryBudget || (hasDeadline && time.Now().Add(delay).After(deadline)) {
+			switch {
+			case rateLimited != nil:
+				resp.Body.Close()
+				return nil, rateLimited
+			case err != nil:
+				return nil, errors.Wrapf(err, "request to [%s %s] failed after %d attempts", request.Method, request.URL, attempt+1)
+			}
+			// Let the caller report the last server side failure along with its body.
+			return resp, nil
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		waited += delay
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "request to [%s %s] did not complete in time", request.Method, request.URL)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryAfter reads how long Bitbucket asks clients to wait before retrying, if it says so.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return nonNegative(time.Until(at)), true
+		}
+	}
+	if value := resp.Header.Get("X-RateLimit-Reset"); value != "" {
+		if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return nonNegative(time.Until(time.Unix(epoch, 0))), true
+		}
+	}
+	return 0, false
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// backoff returns the exponential delay before retry number attempt+1, capped at ceiling, with up to a second of jitter.
+func backoff(attempt int, ceiling time.Duration) time.Duration {
+	delay := ceiling
+	if attempt < 16 {
+		delay = time.Duration(1<<uint(attempt)) * time.Second
+	}
+	if delay > ceiling {
+		delay = ceiling
+	}
+	return delay + time.Duration(rand.Int63n(int64(time.Second)))
+}
@@ -0,0 +1,243 @@
+package bitbucket
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// replay serves the given handlers one request after the other, repeating the last one, and counts the requests.
+func replay(handlers ...http.HandlerFunc) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := handlers[len(handlers)-1]
+		if requests < len(handlers) {
+			handler = handlers[requests]
+		}
+		requests++
+		handler(w, r)
+	}))
+	return server, &requests
+}
+
+func respond(status int, headers map[string]string, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+}
+
+func testClient() *Client {
+	return &Client{
+		source:      models.Source{Flavour: Cloud},
+		httpClient:  http.DefaultClient,
+		maxRetries:  DefaultMaxRetries,
+		maxBackoff:  DefaultMaxBackoff,
+		retryBudget: DefaultRetryBudget,
+	}
+}
+
+func TestSendRetriesRateLimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{name: "Retry-After", headers: map[string]string{"Retry-After": "0"}},
+		{name: "X-RateLimit-Reset", headers: map[string]string{"X-RateLimit-Reset": strconv.FormatInt(time.Now().Unix()-1, 10)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := replay(respond(http.StatusTooManyRequests, test.headers, ""), respond(http.StatusOK, nil, `{"id": 7}`))
+			defer server.Close()
+
+			c := testClient()
+			request, err := c.newRequest(context.Background(), http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			pr, err := c.doObject(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if pr.ID != 7 || *requests != 2 {
+				t.Errorf("got pull request %d after %d requests, want 7 after 2", pr.ID, *requests)
+			}
+			// The delay Bitbucket asked for replaces the exponential backoff of at least a second.
+			if elapsed := time.Since(start); elapsed >= time.Second {
+				t.Errorf("retried after %s, want no delay", elapsed)
+			}
+		})
+	}
+}
+
+func TestSendRetryBudgetExceeded(t *testing.T) {
+	server, requests := replay(respond(http.StatusTooManyRequests, map[string]string{"Retry-After": "60"}, ""))
+	defer server.Close()
+
+	c := testClient()
+	c.retryBudget = 10 * time.Second
+	request, err := c.newRequest(context.Background(), http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.do(request, nil)
+	rateLimited, ok := errors.Cause(err).(*RateLimitError)
+	if !ok {
+		t.Fatalf("got error %v, want a RateLimitError", err)
+	}
+	if rateLimited.RetryAfter != time.Minute || *requests != 1 {
+		t.Errorf("got retry after %s after %d requests, want 1m0s after 1", rateLimited.RetryAfter, *requests)
+	}
+}
+
+func TestSendRewindsBody(t *testing.T) {
+	var bodies []string
+	record := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+		}
+	}
+	server, _ := replay(record(http.StatusServiceUnavailable), record(http.StatusOK))
+	defer server.Close()
+
+	c := testClient()
+	request, err := c.newRequest(context.Background(), http.MethodPost, server.URL, map[string]string{"state": "SUCCESSFUL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.do(request, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `{"state":"SUCCESSFUL"}`
+	if len(bodies) != 2 || bodies[0] != want || bodies[1] != want {
+		t.Errorf("got bodies %q, want %q twice", bodies, want)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	in := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	}
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		min, max time.Duration
+		ok       bool
+	}{
+		{name: "seconds", headers: map[string]string{"Retry-After": "5"}, min: 5 * time.Second, max: 5 * time.Second, ok: true},
+		{name: "date", headers: map[string]string{"Retry-After": time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}, min: 58 * time.Second, max: time.Minute, ok: true},
+		{name: "reset", headers: map[string]string{"X-RateLimit-Reset": in(30 * time.Second)}, min: 28 * time.Second, max: 30 * time.Second, ok: true},
+		{name: "reset passed", headers: map[string]string{"X-RateLimit-Reset": in(-time.Minute)}, ok: true},
+		{name: "invalid", headers: map[string]string{"Retry-After": "soon"}},
+		{name: "none"},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		for name, value := range test.headers {
+			resp.Header.Set(name, value)
+		}
+		got, ok := retryAfter(resp)
+		if ok != test.ok || got < test.min || got > test.max {
+			t.Errorf("%s: got %s, %t, want between %s and %s, %t", test.name, got, ok, test.min, test.max, test.ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 0, want: time.Second},
+		{attempt: 3, want: 8 * time.Second},
+		{attempt: 5, want: 30 * time.Second},
+		{attempt: 40, want: 30 * time.Second},
+	}
+	for _, test := range tests {
+		got := backoff(test.attempt, 30*time.Second)
+		if got < test.want || got >= test.want+time.Second {
+			t.Errorf("backoff(%d) = %s, want %s plus less than a second of jitter", test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestSendServerError(t *testing.T) {
+	server, requests := replay(respond(http.StatusInternalServerError, map[string]string{"Retry-After": "0"}, `{"type": "error", "error": {"message": "Something went wrong"}}`))
+	defer server.Close()
+
+	c := testClient()
+	c.maxRetries = 2
+	request, err := c.newRequest(context.Background(), http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.do(request, nil)
+	apiError, ok := errors.Cause(err).(*APIError)
+	if !ok {
+		t.Fatalf("got error %v, want an APIError", err)
+	}
+	if apiError.StatusCode != http.StatusInternalServerError || apiError.Message != "Something went wrong" || *requests != 3 {
+		t.Errorf("got %+v after %d requests, want the message of the last of 3", apiError, *requests)
+	}
+}
+
+func TestNewClientMaxRetries(t *testing.T) {
+	zero, negative := 0, -1
+	tests := []struct {
+		maxRetries *int
+		want       int
+		err        bool
+	}{
+		{maxRetries: nil, want: DefaultMaxRetries},
+		{maxRetries: &zero, want: 0},
+		{maxRetries: &negative, err: true},
+	}
+	for _, test := range tests {
+		source := models.Source{URL: "https://api.bitbucket.org", APIVersion: "2.0", Team: "team", Repo: "repo", Token: "token", MaxRetries: test.maxRetries}
+		c, err := NewClient(context.Background(), source)
+		if test.err {
+			if err == nil {
+				t.Errorf("max_retries %d: expected an error", *test.maxRetries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c.maxRetries != test.want {
+			t.Errorf("got %d retries, want %d", c.maxRetries, test.want)
+		}
+	}
+
+	server, requests := replay(respond(http.StatusBadGateway, map[string]string{"Retry-After": "0"}, "Bad Gateway"))
+	defer server.Close()
+
+	source := models.Source{URL: server.URL, APIVersion: "2.0", Team: "team", Repo: "repo", Token: "token", MaxRetries: &zero}
+	c, err := NewClient(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := c.newRequest(context.Background(), http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.do(request, nil); err == nil || *requests != 1 {
+		t.Errorf("got %v after %d requests, want an error after a single one", err, *requests)
+	}
+}
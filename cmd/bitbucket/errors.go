@@ -0,0 +1,105 @@
+package bitbucket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// APIError is a request Bitbucket answered with an unsuccessful status code.
+type APIError struct {
+	StatusCode int
+	URL        string
+	// Message is the reason Bitbucket gave, or the raw response body when it could not be parsed.
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("request failed, code [%d], url [%s], message: %s", e.StatusCode, e.URL, e.Message)
+}
+
+// NotFoundError is returned when the requested object does not exist, or is invisible to the configured credentials.
+type NotFoundError struct {
+	APIError
+}
+
+// AuthenticationError is returned when Bitbucket rejects the configured credentials.
+type AuthenticationError struct {
+	APIError
+}
+
+// PermissionError is returned when the configured credentials are valid but lack access to the requested object.
+type PermissionError struct {
+	APIError
+}
+
+// ConflictError is returned when the request clashes with the current state of the object, e.g. approving a
+// pull request twice.
+type ConflictError struct {
+	APIError
+}
+
+// IsNotFound reports whether err, or the error it wraps, is a NotFoundError.
+func IsNotFound(err error) bool {
+	_, ok := errors.Cause(err).(*NotFoundError)
+	return ok
+}
+
+// IsConflict reports whether err, or the error it wraps, is a ConflictError.
+func IsConflict(err error) bool {
+	_, ok := errors.Cause(err).(*ConflictError)
+	return ok
+}
+
+// newAPIError builds the error matching the status code of a failed request.
+func newAPIError(statusCode int, url string, body []byte) error {
+	apiError := APIError{StatusCode: statusCode, URL: url, Message: errorMessage(body)}
+	switch statusCode {
+	case http.StatusNotFound:
+		return &NotFoundError{apiError}
+	case http.StatusUnauthorized:
+		return &AuthenticationError{apiError}
+	case http.StatusForbidden:
+		return &PermissionError{apiError}
+	case http.StatusConflict:
+		return &ConflictError{apiError}
+	}
+	return &apiError
+}
+
+// errorMessage extracts the reason from a Bitbucket error body.
+func errorMessage(body []byte) string {
+	var response models.ErrorResponse
+	if err := json.Unmarshal(body, &response); err == nil {
+		if response.Error.Message != "" {
+			if response.Error.Detail != "" {
+				return response.Error.Message + ": " + response.Error.Detail
+			}
+			return response.Error.Message
+		}
+		var messages []string
+		for _, e := range response.Errors {
+			messages = append(messages, e.Message)
+		}
+		if len(messages) > 0 {
+			return strings.Join(messages, "; ")
+		}
+	}
+	return string(body)
+}
+
+// RateLimitError is returned when Bitbucket keeps rate limiting a request beyond what the retry settings allow.
+type RateLimitError struct {
+	URL        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by Bitbucket on [%s], retry after %s", e.URL, e.RetryAfter-e.RetryAfter%time.Second)
+}
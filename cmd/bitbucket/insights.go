@@ -0,0 +1,96 @@
+package bitbucket
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// maxAnnotationsPerRequest is the number of annotations Bitbucket accepts in a single request.
+const maxAnnotationsPerRequest = 100
+
+// reportURL returns the API endpoint of a Code Insights report of a commit.
+func reportURL(source models.Source, commit, key string) string {
+	if source.Flavour == Server {
+		return source.URL + "/rest/insights/1.0/projects/" + source.Team + "/repos/" + source.Repo + "/commits/" + commit + "/reports/" + key
+	}
+	return source.URL + "/" + source.APIVersion + "/repositories/" + source.Team + "/" + source.Repo + "/commit/" + commit + "/reports/" + key
+}
+
+// PublishReport creates or replaces the Code Insights report with the given key on a commit, along with its annotations.
+// The previous report is deleted first, so annotations of earlier runs do not linger. The type defaults to TEST
+// and the details to the Concourse build publishing the report.
+func (c *Client) PublishReport(ctx context.Context, commit, key string, report models.Report, annotations []models.Annotation) error {
+	// Ref https://developer.atlassian.com/cloud/bitbucket/rest/api-group-reports/
+
+	if commit == "" {
+		return errors.New("commit must be provided")
+	}
+	if key == "" {
+		return errors.New("report key must be provided")
+	}
+	if report.Title == "" {
+		return errors.New("report title must be provided")
+	}
+
+	endpoint := reportURL(c.source, commit, key)
+	req, err := c.newRequest(ctx, "DELETE", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	err = c.do(req, nil)
+	if err != nil && !IsNotFound(err) {
+		return errors.Wrap(err, "request to delete previous report failed")
+	}
+
+	// Bitbucket Cloud rejects reports without a type or details.
+	if report.ReportType == "" {
+		report.ReportType = "TEST"
+	}
+	if report.Details == "" {
+		report.Details = fmt.Sprintf("Reported by Concourse build %s/%s #%s", os.Getenv("BUILD_PIPELINE_NAME"), os.Getenv("BUILD_JOB_NAME"), os.Getenv("BUILD_NAME"))
+	}
+
+	var body interface{} = report
+	if c.source.Flavour == Server {
+		body = toServerReport(report)
+	}
+	req, err = c.newRequest(ctx, "PUT", endpoint, body)
+	if err != nil {
+		return err
+	}
+	err = c.do(req, nil)
+	if err != nil {
+		return errors.Wrap(err, "request to create report failed")
+	}
+
+	for i := range annotations {
+		if annotations[i].ExternalID == "" {
+			annotations[i].ExternalID = fmt.Sprintf("%s-%d", key, i+1)
+		}
+	}
+	for start := 0; start < len(annotations); start += maxAnnotationsPerRequest {
+		end := start + maxAnnotationsPerRequest
+		if end > len(annotations) {
+			end = len(annotations)
+		}
+
+		body = annotations[start:end]
+		if c.source.Flavour == Server {
+			body = map[string]interface{}{"annotations": toServerAnnotations(annotations[start:end])}
+		}
+		req, err = c.newRequest(ctx, "POST", endpoint+"/annotations", body)
+		if err != nil {
+			return err
+		}
+		err = c.do(req, nil)
+		if err != nil {
+			return errors.Wrapf(err, "request to add annotations %d to %d failed", start+1, end)
+		}
+	}
+	return nil
+}
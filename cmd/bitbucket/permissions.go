@@ -0,0 +1,80 @@
+package bitbucket
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// Repository permissions, from least to most privileged.
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+	PermissionAdmin = "admin"
+)
+
+// permissionRanks orders the permissions so they can be compared. Users without access rank lowest.
+var permissionRanks = map[string]int{
+	"":              0,
+	PermissionRead:  1,
+	PermissionWrite: 2,
+	PermissionAdmin: 3,
+}
+
+// PermissionAtLeast reports whether permission grants at least as much as required.
+func PermissionAtLeast(permission, required string) bool {
+	return permissionRanks[permission] >= permissionRanks[required]
+}
+
+// ValidPermission reports whether permission is one of read, write or admin.
+func ValidPermission(permission string) bool {
+	_, ok := permissionRanks[permission]
+	return ok && permission != ""
+}
+
+// GetRepositoryPermission returns the permission of a user on the configured repository, one of read, write or
+// admin, or an empty string without access. Looking up other users requires admin rights on the workspace on
+// Bitbucket Cloud, and on the repository on Bitbucket Server.
+func (c *Client) GetRepositoryPermission(ctx context.Context, user models.Author) (string, error) {
+	// Ref https://developer.atlassian.com/cloud/bitbucket/rest/api-group-workspaces/#api-workspaces-workspace-permissions-repositories-repo-slug-get
+
+	if c.source.Flavour == Server {
+		return c.getServerRepositoryPermission(ctx, user)
+	}
+
+	if user.UUID == "" {
+		return "", errors.New("user UUID must be provided")
+	}
+
+	query := url.Values{}
+	query.Set("q", `user.uuid="`+user.UUID+`"`)
+	endpoint := c.source.URL + "/" + c.source.APIVersion + "/workspaces/" + c.source.Team + "/permissions/repositories/" + c.source.Repo + "?" + query.Encode()
+	req, err := c.newRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		Values []json.RawMessage `json:"values"`
+	}
+	err = c.do(req, &response)
+	if err != nil {
+		return "", errors.Wrap(err, "request to retrieve repository permission failed")
+	}
+
+	var permission string
+	for _, value := range response.Values {
+		var granted models.RepositoryPermission
+		if err := json.Unmarshal(value, &granted); err != nil {
+			return "", errors.Wrap(err, "failed to decode repository permission")
+		}
+		if permissionRanks[granted.Permission] > permissionRanks[permission] {
+			permission = granted.Permission
+		}
+	}
+	return permission, nil
+}
@@ -0,0 +1,541 @@
+package bitbucket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// Bitbucket Server exposes the same concepts as Cloud with differently shaped payloads. The functions
+// below fetch those payloads and convert them into GenericResponses so check, in and out can stay
+// unaware of the flavour they are talking to.
+
+// doServerSlice will iterate over the pages of a Bitbucket Server collection, passing every value to each
+func (c *Client) doServerSlice(request *http.Request, each func(json.RawMessage) error) error {
+	query := request.URL.Query()
+	for {
+		var response models.ServerPagedResponse
+		err := c.do(request, &response)
+		if err != nil {
+			return errors.Wrapf(err, "failed to retrieve values")
+		}
+		for _, value := range response.Values {
+			if err := each(value); err != nil {
+				return errors.Wrap(err, "failed to decode value")
+			}
+		}
+		if response.IsLastPage || len(response.Values) == 0 {
+			break
+		}
+		query.Set("start", strconv.Itoa(response.NextPageStart))
+		request.URL.RawQuery = query.Encode()
+	}
+	return nil
+}
+
+func (c *Client) getServerPullRequests(req *http.Request) (*[]models.GenericResponse, error) {
+	var prs []models.GenericResponse
+	err := c.doServerSlice(req, func(value json.RawMessage) error {
+		var pr models.ServerPullRequest
+		if err := json.Unmarshal(value, &pr); err != nil {
+			return err
+		}
+		prs = append(prs, fromServerPullRequest(c.source, pr))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve pull requests failed")
+	}
+	return &prs, nil
+}
+
+func (c *Client) getServerPullRequest(req *http.Request) (*models.GenericResponse, error) {
+	var pr models.ServerPullRequest
+	err := c.do(req, &pr)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve pull request failed")
+	}
+	response := fromServerPullRequest(c.source, pr)
+	return &response, nil
+}
+
+func (c *Client) getServerCommitStatuses(req *http.Request) ([]models.CommitStatus, error) {
+	var statuses []models.CommitStatus
+	err := c.doServerSlice(req, func(value json.RawMessage) error {
+		var status models.ServerBuildStatus
+		if err := json.Unmarshal(value, &status); err != nil {
+			return err
+		}
+		statuses = append(statuses, models.CommitStatus{
+			Type:        "build",
+			State:       status.State,
+			Key:         status.Key,
+			Name:        status.Name,
+			URL:         status.URL,
+			Description: status.Description,
+			CreatedOn:   serverTime(status.DateAdded),
+			UpdatedOn:   serverTime(status.DateAdded),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve commit statuses failed")
+	}
+	return statuses, nil
+}
+
+// getServerComments returns the top level or inline comments of a pull request, read from its activity stream.
+func (c *Client) getServerComments(ctx context.Context, pr models.GenericResponse, inline bool) ([]models.Comment, error) {
+	req, err := c.newRequest(ctx, "GET", pullRequestsURL(c.source)+"/"+strconv.Itoa(pr.ID)+"/activities", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var comments []models.Comment
+	err = c.doServerSlice(req, func(value json.RawMessage) error {
+		var activity models.ServerActivity
+		if err := json.Unmarshal(value, &activity); err != nil {
+			return err
+		}
+		// Only new comments are of interest, skipping over replies.
+		if activity.Action != "COMMENTED" || activity.CommentAction != "ADDED" || activity.Comment == nil || (activity.CommentAnchor != nil) != inline {
+			return nil
+		}
+		comment := fromServerComment(pr, *activity.Comment)
+		if activity.CommentAnchor != nil {
+			comment.Inline.Path = activity.CommentAnchor.Path
+			comment.Inline.To = activity.CommentAnchor.Line
+		}
+		comments = append(comments, *comment)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve pull request activities failed")
+	}
+	// The activity stream is newest first, whereas Cloud lists comments oldest first.
+	for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
+		comments[i], comments[j] = comments[j], comments[i]
+	}
+	return comments, nil
+}
+
+func (c *Client) createServerComment(ctx context.Context, pr models.GenericResponse, text string) (*models.Comment, error) {
+	req, err := c.newRequest(ctx, "POST", pullRequestsURL(c.source)+"/"+strconv.Itoa(pr.ID)+"/comments", map[string]string{"text": text})
+	if err != nil {
+		return nil, err
+	}
+
+	var comment models.ServerComment
+	err = c.do(req, &comment)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to create comment failed")
+	}
+	return fromServerComment(pr, comment), nil
+}
+
+func (c *Client) createServerInlineComment(ctx context.Context, pr models.GenericResponse, path string, line int, text string) (*models.Comment, error) {
+	anchor := models.ServerCommentAnchor{Path: path, FileType: "TO"}
+	if line > 0 {
+		anchor.Line = line
+		anchor.LineType = "ADDED"
+	}
+	body := map[string]interface{}{"text": text, "anchor": anchor}
+	req, err := c.newRequest(ctx, "POST", pullRequestsURL(c.source)+"/"+strconv.Itoa(pr.ID)+"/comments", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var comment models.ServerComment
+	err = c.do(req, &comment)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to create inline comment failed")
+	}
+	response := fromServerComment(pr, comment)
+	response.Inline.Path = path
+	response.Inline.To = line
+	return response, nil
+}
+
+func (c *Client) updateServerComment(ctx context.Context, pr models.GenericResponse, comment models.Comment, text string) (*models.Comment, error) {
+	// Bitbucket Server rejects the edit unless it names the comment version it applies to.
+	body := map[string]interface{}{"text": text, "version": comment.Version}
+	req, err := c.newRequest(ctx, "PUT", commentURL(c.source, pr, comment), body)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated models.ServerComment
+	err = c.do(req, &updated)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to update comment failed")
+	}
+	return fromServerComment(pr, updated), nil
+}
+
+func (c *Client) getServerChangedPaths(ctx context.Context, pr models.GenericResponse) ([]string, error) {
+	req, err := c.newRequest(ctx, "GET", pullRequestsURL(c.source)+"/"+strconv.Itoa(pr.ID)+"/changes", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	err = c.doServerSlice(req, func(value json.RawMessage) error {
+		var change models.ServerChange
+		if err := json.Unmarshal(value, &change); err != nil {
+			return err
+		}
+		if change.SrcPath != nil && change.SrcPath.ToString != "" && change.SrcPath.ToString != change.Path.ToString {
+			paths = append(paths, change.SrcPath.ToString)
+		}
+		paths = append(paths, change.Path.ToString)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve pull request changes failed")
+	}
+	return paths, nil
+}
+
+func (c *Client) approveServerPullRequest(req *http.Request) (*models.GenericResponse, error) {
+	var participant models.ServerParticipant
+	err := c.do(req, &participant)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to approve pull request failed")
+	}
+	return &models.GenericResponse{Type: "participant", User: fromServerUser(participant.User)}, nil
+}
+
+func (c *Client) declineServerPullRequest(ctx context.Context, request string) (*models.GenericResponse, error) {
+	req, err := c.newRequest(ctx, "GET", pullRequestsURL(c.source)+"/"+request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var pr models.ServerPullRequest
+	err = c.do(req, &pr)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve pull request failed")
+	}
+
+	// Bitbucket Server rejects the decline unless it names the pull request version it applies to.
+	req, err = c.newRequest(ctx, "POST", fmt.Sprintf("%s/%s/decline?version=%d", pullRequestsURL(c.source), request, pr.Version), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.getServerPullRequest(req)
+}
+
+func (c *Client) getServerCommit(ctx context.Context, hash string) (*models.Commit, error) {
+	endpoint := c.source.URL + "/rest/api/" + c.source.APIVersion + "/projects/" + c.source.Team + "/repos/" + c.source.Repo + "/commits/" + hash
+	req, err := c.newRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var commit models.ServerCommit
+	err = c.do(req, &commit)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve commit failed")
+	}
+	return &models.Commit{Hash: commit.ID, Date: serverTime(commit.CommitterTimestamp), Message: commit.Message}, nil
+}
+
+// serverMergeStrategies maps the Cloud merge strategies onto the IDs of the Bitbucket Server ones.
+var serverMergeStrategies = map[string]string{
+	MergeStrategyMergeCommit: "no-ff",
+	MergeStrategySquash:      "squash",
+	MergeStrategyFastForward: "ff-only",
+}
+
+func (c *Client) mergeServerPullRequest(ctx context.Context, pr models.GenericResponse, strategy, message string, closeSourceBranch bool) (*models.GenericResponse, error) {
+	request := strconv.Itoa(pr.ID)
+	req, err := c.newRequest(ctx, "GET", pullRequestsURL(c.source)+"/"+request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var current models.ServerPullRequest
+	err = c.do(req, &current)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to retrieve pull request failed")
+	}
+	if current.FromRef.LatestCommit != pr.Source.Commit.Hash {
+		return nil, errors.Errorf("pull request #%d moved on to %s while merging %s", pr.ID, current.FromRef.LatestCommit, pr.Source.Commit.Hash)
+	}
+
+	body := map[string]interface{}{}
+	if strategy != "" {
+		body["strategyId"] = serverMergeStrategies[strategy]
+	}
+	if message != "" {
+		body["message"] = message
+	}
+
+	// Bitbucket Server rejects the merge unless it names the pull request version it applies to.
+	req, err = c.newRequest(ctx, "POST", fmt.Sprintf("%s/%s/merge?version=%d", pullRequestsURL(c.source), request, current.Version), body)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := c.getServerPullRequest(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request to merge pull request failed")
+	}
+
+	if closeSourceBranch {
+		if err := c.deleteServerBranch(ctx, current.FromRef); err != nil {
+			return merged, err
+		}
+	}
+	return merged, nil
+}
+
+// deleteServerBranch removes the source branch of a merged pull request, which Bitbucket Server leaves behind.
+func (c *Client) deleteServerBranch(ctx context.Context, ref models.ServerRef) error {
+	endpoint := c.source.URL + "/rest/branch-utils/1.0/projects/" + ref.Repository.Project.Key + "/repos/" + ref.Repository.Slug + "/branches"
+	req, err := c.newRequest(ctx, "DELETE", endpoint, map[string]interface{}{"name": ref.ID, "dryRun": false})
+	if err != nil {
+		return err
+	}
+
+	err = c.do(req, nil)
+	if err != nil {
+		return errors.Wrapf(err, "request to delete branch %s failed", ref.DisplayID)
+	}
+	return nil
+}
+
+// setServerParticipantStatus sets the review status of the configured user on a pull request.
+func (c *Client) setServerParticipantStatus(ctx context.Context, request, status string) error {
+	user, err := c.serverUsername(ctx)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{"user": map[string]string{"name": user}, "status": status}
+	req, err := c.newRequest(ctx, "PUT", pullRequestsURL(c.source)+"/"+request+"/participants/"+url.PathEscape(user), body)
+	if err != nil {
+		return err
+	}
+
+	err = c.do(req, nil)
+	if err != nil {
+		return errors.Wrapf(err, "request to set review status %s failed", status)
+	}
+	return nil
+}
+
+// serverUsername returns the name of the user the client is authenticated as. Bitbucket Server has no REST
+// endpoint for it, the application links servlet answers with the bare username instead.
+func (c *Client) serverUsername(ctx context.Context) (string, error) {
+	req, err := c.newRequest(ctx, "GET", c.source.URL+"/plugins/servlet/applinks/whoami", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return "", errors.Wrap(err, "request to identify the current user failed")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read response body")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", newAPIError(resp.StatusCode, req.URL.String(), body)
+	}
+
+	user := strings.TrimSpace(string(body))
+	if user == "" {
+		return "", errors.New("the configured credentials are not associated with a user")
+	}
+	return user, nil
+}
+
+// toServerReport converts a Cloud shaped report for Bitbucket Server, which only knows whether it passed or failed.
+func toServerReport(report models.Report) models.ServerReport {
+	response := models.ServerReport{
+		Title:    report.Title,
+		Details:  report.Details,
+		Reporter: report.Reporter,
+		Link:     report.Link,
+		Data:     report.Data,
+	}
+	switch report.Result {
+	case "PASSED":
+		response.Result = "PASS"
+	case "FAILED":
+		response.Result = "FAIL"
+	}
+	return response
+}
+
+func toServerAnnotations(annotations []models.Annotation) []models.ServerAnnotation {
+	var response []models.ServerAnnotation
+	for _, annotation := range annotations {
+		message := annotation.Summary
+		if annotation.Details != "" {
+			message += "\n\n" + annotation.Details
+		}
+		severity := annotation.Severity
+		switch severity {
+		case "CRITICAL":
+			severity = "HIGH"
+		case "":
+			severity = "LOW"
+		}
+		response = append(response, models.ServerAnnotation{
+			ExternalID: annotation.ExternalID,
+			Path:       annotation.Path,
+			Line:       annotation.Line,
+			Message:    message,
+			Severity:   severity,
+			Type:       annotation.AnnotationType,
+			Link:       annotation.Link,
+		})
+	}
+	return response
+}
+
+// serverPermissions maps Bitbucket Server project and repository permissions onto repository permissions.
+var serverPermissions = map[string]string{
+	"PROJECT_READ":  PermissionRead,
+	"REPO_READ":     PermissionRead,
+	"PROJECT_WRITE": PermissionWrite,
+	"REPO_WRITE":    PermissionWrite,
+	"PROJECT_ADMIN": PermissionAdmin,
+	"REPO_ADMIN":    PermissionAdmin,
+}
+
+// getServerRepositoryPermission returns the highest of the permissions granted to a user on the repository and on
+// its project. Permissions granted through groups are not taken into account.
+func (c *Client) getServerRepositoryPermission(ctx context.Context, user models.Author) (string, error) {
+	if user.Username == "" {
+		return "", errors.New("username must be provided")
+	}
+
+	project := c.source.URL + "/rest/api/" + c.source.APIVersion + "/projects/" + c.source.Team
+	var permission string
+	for _, endpoint := range []string{project + "/permissions/users", project + "/repos/" + c.source.Repo + "/permissions/users"} {
+		req, err := c.newRequest(ctx, "GET", endpoint+"?filter="+url.QueryEscape(user.Username), nil)
+		if err != nil {
+			return "", err
+		}
+
+		err = c.doServerSlice(req, func(value json.RawMessage) error {
+			var granted models.ServerPermission
+			if err := json.Unmarshal(value, &granted); err != nil {
+				return err
+			}
+			// The filter matches on substrings of names, only the user itself counts.
+			if granted.User.Name != user.Username {
+				return nil
+			}
+			if mapped := serverPermissions[granted.Permission]; permissionRanks[mapped] > permissionRanks[permission] {
+				permission = mapped
+			}
+			return nil
+		})
+		if err != nil {
+			return "", errors.Wrap(err, "request to retrieve repository permission failed")
+		}
+	}
+	return permission, nil
+}
+
+// serverParticipantStates maps the review status of Bitbucket Server participants onto Cloud participant states.
+var serverParticipantStates = map[string]string{
+	"APPROVED":   "approved",
+	"NEEDS_WORK": "changes_requested",
+}
+
+// fromServerPullRequest converts a Bitbucket Server pull request into the Cloud shaped GenericResponse.
+func fromServerPullRequest(source models.Source, pr models.ServerPullRequest) models.GenericResponse {
+	var response models.GenericResponse
+	response.Type = "pullrequest"
+	response.ID = pr.ID
+	response.Title = pr.Title
+	response.Description = pr.Description
+	response.State = pr.State
+	response.Draft = pr.Draft
+	response.CreatedOn = serverTime(pr.CreatedDate)
+	response.UpdatedOn = serverTime(pr.UpdatedDate)
+	response.CommentCount = pr.Properties.CommentCount
+	response.TaskCount = pr.Properties.OpenTaskCount
+	response.Author = fromServerUser(pr.Author.User)
+
+	response.Source.Branch.Name = pr.FromRef.DisplayID
+	response.Source.Commit.Hash = pr.FromRef.LatestCommit
+	response.Source.Repository.FullName = pr.FromRef.Repository.Project.Key + "/" + pr.FromRef.Repository.Slug
+	response.Source.Repository.Name = pr.FromRef.Repository.Name
+	response.Source.Repository.Type = "repository"
+
+	response.Destination.Branch.Name = pr.ToRef.DisplayID
+	response.Destination.Commit.Hash = pr.ToRef.LatestCommit
+	response.Destination.Repository.FullName = pr.ToRef.Repository.Project.Key + "/" + pr.ToRef.Repository.Slug
+	response.Destination.Repository.Name = pr.ToRef.Repository.Name
+	response.Destination.Repository.Type = "repository"
+
+	for _, participant := range append(pr.Reviewers, pr.Participants...) {
+		response.Participants = append(response.Participants, models.Participant{
+			Approved: participant.Approved,
+			Role:     participant.Role,
+			State:    serverParticipantStates[participant.Status],
+			Type:     "participant",
+			User:     fromServerUser(participant.User),
+
+			LastReviewedCommit: participant.LastReviewedCommit,
+		})
+	}
+
+	response.Links.Self.Href = pullRequestsURL(source) + "/" + strconv.Itoa(pr.ID)
+	if len(pr.Links.Self) > 0 {
+		response.Links.HTML.Href = pr.Links.Self[0].Href
+	}
+	return response
+}
+
+func fromServerComment(pr models.GenericResponse, comment models.ServerComment) *models.Comment {
+	return &models.Comment{
+		ID:        comment.ID,
+		Version:   comment.Version,
+		User:      fromServerUser(comment.Author),
+		Content:   models.CommentContent{Raw: comment.Text},
+		CreatedOn: serverTime(comment.CreatedDate),
+		UpdatedOn: serverTime(comment.UpdatedDate),
+		Link:      fmt.Sprintf("%s?commentId=%d", pr.Links.HTML.Href, comment.ID),
+	}
+}
+
+func fromServerUser(user models.ServerUser) models.Author {
+	author := models.Author{
+		DisplayName: user.DisplayName,
+		Type:        "user",
+		Username:    user.Name,
+		UUID:        strconv.Itoa(user.ID),
+	}
+	if len(user.Links.Self) > 0 {
+		author.Links.HTML.Href = user.Links.Self[0].Href
+	}
+	return author
+}
+
+// serverTime converts the millisecond timestamps used by Bitbucket Server.
+func serverTime(millis int64) time.Time {
+	if millis == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
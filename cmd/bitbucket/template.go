@@ -0,0 +1,46 @@
+package bitbucket
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// buildEnv lists the Concourse build metadata made available to templates under their own name.
+var buildEnv = []string{
+	"BUILD_ID",
+	"BUILD_NAME",
+	"BUILD_JOB_NAME",
+	"BUILD_PIPELINE_NAME",
+	"BUILD_TEAM_NAME",
+	"ATC_EXTERNAL_URL",
+}
+
+// Render executes text as a Go template over the build metadata, the link to the build and the pull request.
+// in and out share it, so values both of them set, such as status keys, render the same.
+// Unknown keys, such as a misspelled variable, fail rather than render as "<no value>".
+func Render(text string, source models.Source, pr models.GenericResponse) (string, error) {
+	tmpl, err := template.New("params").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to parse template")
+	}
+
+	data := map[string]interface{}{
+		"PullRequest": pr,
+		"BuildURL":    BuildURL(source.ConcourseURL),
+	}
+	for _, name := range buildEnv {
+		data[name] = os.Getenv(name)
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", errors.Wrap(err, "unable to render template")
+	}
+	return strings.TrimSpace(out.String()), nil
+}
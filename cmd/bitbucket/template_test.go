@@ -0,0 +1,26 @@
+package bitbucket
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+func TestRender(t *testing.T) {
+	os.Setenv("BUILD_NAME", "42")
+	defer os.Unsetenv("BUILD_NAME")
+
+	pr := models.GenericResponse{ID: 7}
+	got, err := Render(" Build #{{.BUILD_NAME}} of #{{.PullRequest.ID}} ", models.Source{}, pr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "Build #42 of #7" {
+		t.Errorf("got %q, want %q", got, "Build #42 of #7")
+	}
+
+	if got, err := Render("Build #{{.BUILD_NAM}}", models.Source{}, pr); err == nil {
+		t.Errorf("got %q, want an error for the unknown key", got)
+	}
+}
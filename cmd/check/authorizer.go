@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// authorizer decides who is trusted, e.g. to issue comment commands, from an allowlist of users and/or a minimum
+// permission on the repository. Everyone is when neither is configured.
+type authorizer struct {
+	// name prefixes the settings configuring the authorizer, e.g. "command" for command_users and command_permission.
+	name       string
+	client     *bitbucket.Client
+	users      []string
+	permission string
+	// permissions caches the permission of every user looked up so far.
+	permissions map[string]string
+}
+
+func newAuthorizer(client *bitbucket.Client, name string, users []string, permission string) (*authorizer, error) {
+	if permission != "" && !bitbucket.ValidPermission(strings.ToLower(permission)) {
+		return nil, errors.Errorf("invalid %s_permission %q, must be one of %q, %q or %q",
+			name, permission, bitbucket.PermissionRead, bitbucket.PermissionWrite, bitbucket.PermissionAdmin)
+	}
+	permission = strings.ToLower(permission)
+	return &authorizer{
+		name:        name,
+		client:      client,
+		users:       users,
+		permission:  permission,
+		permissions: map[string]string{},
+	}, nil
+}
+
+// configured reports whether the authorizer restricts anything.
+func (a *authorizer) configured() bool {
+	return len(a.users) > 0 || a.permission != ""
+}
+
+// authorize reports whether user is trusted, and why not when it is not.
+func (a *authorizer) authorize(ctx context.Context, user models.Author) (bool, string, error) {
+	if !a.configured() {
+		return true, "", nil
+	}
+	for _, allowed := range a.users {
+		if sameUser(user, allowed) {
+			return true, "", nil
+		}
+	}
+	if a.permission == "" {
+		return false, "not listed in " + a.name + "_users", nil
+	}
+
+	id := user.UUID + "/" + user.Username
+	permission, ok := a.permissions[id]
+	if !ok {
+		var err error
+		permission, err = a.client.GetRepositoryPermission(ctx, user)
+		if err != nil {
+			return false, "", err
+		}
+		a.permissions[id] = permission
+	}
+	if bitbucket.PermissionAtLeast(permission, a.permission) {
+		return true, "", nil
+	}
+	if permission == "" {
+		permission = "no"
+	}
+	return false, fmt.Sprintf("has %s permission on the repository, %s is required", permission, a.permission), nil
+}
+
+// sameUser matches a user against an entry of an allowlist, which may be a username, nickname, account ID or UUID.
+func sameUser(user models.Author, entry string) bool {
+	if entry == "" {
+		return false
+	}
+	trim := func(uuid string) string { return strings.Trim(uuid, "{}") }
+	return entry == user.Username || entry == user.Nickname || entry == user.AccountID || (user.UUID != "" && trim(entry) == trim(user.UUID))
+}
+
+func userName(user models.Author) string {
+	for _, name := range []string{user.Username, user.Nickname, user.DisplayName, user.UUID} {
+		if name != "" {
+			return name
+		}
+	}
+	return "unknown user"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// defaultCommands are the comment commands recognised when the source does not configure `commands`.
+var defaultCommands = []string{"/retest"}
+
+// command is a comment command issued on a pull request.
+type command struct {
+	Name      string
+	Arguments string
+	Link      string
+}
+
+// findCommand returns the most recent command among comments posted after since, or nil. A comment issues a
+// command when its first line is one of commands, optionally followed by arguments, and its author is authorized.
+// Commands posted before since have already been picked up by a build, which is how every command triggers exactly once.
+func findCommand(comments []models.Comment, commands []string, since time.Time, authorize func(models.Author) (bool, string, error)) (*command, error) {
+	if len(commands) == 0 {
+		commands = defaultCommands
+	}
+
+	for i := len(comments) - 1; i >= 0; i-- {
+		comment := comments[i]
+		if !comment.CreatedOn.After(since) {
+			continue
+		}
+		line := strings.TrimSpace(strings.Split(comment.Content.Raw, "\n")[0])
+		name, arguments, ok := parseCommand(line, commands)
+		if !ok {
+			continue
+		}
+
+		allowed, reason, err := authorize(comment.User)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			log.Printf("Ignoring %q from %s at %s: %s", line, userName(comment.User), comment.Link, reason)
+			continue
+		}
+		return &command{Name: name, Arguments: arguments, Link: comment.Link}, nil
+	}
+	return nil, nil
+}
+
+// parseCommand matches line against the longest of commands, which may themselves carry fixed arguments
+// such as "/deploy staging".
+func parseCommand(line string, commands []string) (string, string, bool) {
+	var name string
+	for _, candidate := range commands {
+		if len(candidate) <= len(name) {
+			continue
+		}
+		if line == candidate || strings.HasPrefix(line, candidate+" ") {
+			name = candidate
+		}
+	}
+	if name == "" {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(strings.TrimPrefix(line, name)), true
+}
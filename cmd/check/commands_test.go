@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+func TestParseCommand(t *testing.T) {
+	commands := []string{"/retest", "/deploy", "/deploy staging"}
+	tests := []struct {
+		line      string
+		name      string
+		arguments string
+		ok        bool
+	}{
+		{line: "/retest", name: "/retest", ok: true},
+		{line: "/retest  unit  ", name: "/retest", arguments: "unit", ok: true},
+		{line: "/deploy production", name: "/deploy", arguments: "production", ok: true},
+		{line: "/deploy staging", name: "/deploy staging", ok: true},
+		{line: "/deploy staging eu-west-1", name: "/deploy staging", arguments: "eu-west-1", ok: true},
+		{line: "/retests", ok: false},
+		{line: "please /retest", ok: false},
+		{line: "", ok: false},
+	}
+	for _, test := range tests {
+		name, arguments, ok := parseCommand(test.line, commands)
+		if name != test.name || arguments != test.arguments || ok != test.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %t, want %q, %q, %t", test.line, name, arguments, ok, test.name, test.arguments, test.ok)
+		}
+	}
+}
+
+func comment(raw, user string, at time.Time) models.Comment {
+	c := models.Comment{CreatedOn: at, User: models.Author{Username: user}, Link: raw + " by " + user}
+	c.Content.Raw = raw
+	return c
+}
+
+func allowAll(models.Author) (bool, string, error) {
+	return true, "", nil
+}
+
+func TestFindCommand(t *testing.T) {
+	since := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	before, after, later := since.Add(-time.Minute), since.Add(time.Minute), since.Add(2*time.Minute)
+
+	tests := []struct {
+		name     string
+		comments []models.Comment
+		commands []string
+		want     *command
+	}{
+		{
+			name:     "default command",
+			comments: []models.Comment{comment("/retest\nplease", "alice", after)},
+			want:     &command{Name: "/retest", Link: "/retest\nplease by alice"},
+		},
+		{
+			name:     "posted before since",
+			comments: []models.Comment{comment("/retest", "alice", before), comment("/retest", "alice", since)},
+			want:     nil,
+		},
+		{
+			name:     "most recent command wins",
+			comments: []models.Comment{comment("/deploy staging", "alice", after), comment("/deploy prod", "bob", later), comment("LGTM", "carol", later)},
+			commands: []string{"/deploy"},
+			want:     &command{Name: "/deploy", Arguments: "prod", Link: "/deploy prod by bob"},
+		},
+		{
+			name:     "not a configured command",
+			comments: []models.Comment{comment("/retest", "alice", after)},
+			commands: []string{"/deploy"},
+			want:     nil,
+		},
+	}
+	for _, test := range tests {
+		got, err := findCommand(test.comments, test.commands, since, allowAll)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFindCommandUnauthorized(t *testing.T) {
+	since := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	comments := []models.Comment{
+		comment("/retest first", "alice", since.Add(time.Minute)),
+		comment("/retest second", "mallory", since.Add(2*time.Minute)),
+	}
+	onlyAlice := func(user models.Author) (bool, string, error) {
+		return user.Username == "alice", "not listed in command_users", nil
+	}
+
+	got, err := findCommand(comments, nil, since, onlyAlice)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got == nil || got.Arguments != "first" {
+		t.Errorf("got %+v, want the command of alice", got)
+	}
+
+	got, err = findCommand(comments[1:], nil, since, onlyAlice)
+	if err != nil || got != nil {
+		t.Errorf("got %+v, %v, want no command", got, err)
+	}
+
+	failing := func(models.Author) (bool, string, error) {
+		return false, "", errors.New("permission lookup failed")
+	}
+	if _, err := findCommand(comments, nil, since, failing); err == nil {
+		t.Error("expected the error of the permission lookup")
+	}
+}
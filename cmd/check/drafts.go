@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// defaultDraftTitles are the title prefixes marking drafts when the source does not configure `draft_titles`.
+var defaultDraftTitles = []string{"WIP", "[WIP]", "Draft:"}
+
+// skipCI matches the markers asking for a commit not to be built.
+var skipCI = regexp.MustCompile(`(?i)\[(skip ci|ci skip)\]`)
+
+// isDraft reports whether a pull request is a draft, either flagged as such or titled like one.
+// Titles match when they start with one of titles, ignoring case, as a whole word unless the prefix ends in
+// punctuation.
+func isDraft(pr models.GenericResponse, titles []string) bool {
+	if pr.Draft {
+		return true
+	}
+	if titles == nil {
+		titles = defaultDraftTitles
+	}
+
+	title := strings.TrimSpace(pr.Title)
+	for _, prefix := range titles {
+		if prefix == "" || len(title) < len(prefix) || !strings.EqualFold(title[:len(prefix)], prefix) {
+			continue
+		}
+		// "WIP" marks "WIP: fix" and "WIP fix", but not "Wipe the cache". "[WIP]" marks "[WIP]fix" too.
+		last, _ := utf8.DecodeLastRuneInString(prefix)
+		next, _ := utf8.DecodeRuneInString(title[len(prefix):])
+		if !isAlphanumeric(last) || next == utf8.RuneError || !isAlphanumeric(next) {
+			return true
+		}
+	}
+	return false
+}
+
+func isAlphanumeric(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// skipsCI reports whether a commit message asks for the commit not to be built.
+func skipsCI(commit models.Commit) bool {
+	return skipCI.MatchString(commit.Message)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+func TestIsDraft(t *testing.T) {
+	tests := []struct {
+		title  string
+		draft  bool
+		titles []string
+		want   bool
+	}{
+		{title: "Fix the build", draft: true, want: true},
+		{title: "Fix the build", want: false},
+		{title: "WIP", want: true},
+		{title: "WIP: fix the build", want: true},
+		{title: "wip fix the build", want: true},
+		{title: "  WIP fix the build", want: true},
+		{title: "Wipe the cache", want: false},
+		{title: "WIP2 of the build", want: false},
+		{title: "[WIP] fix the build", want: true},
+		{title: "Draft: fix the build", want: true},
+		{title: "[WIP]fix the build", want: true},
+		{title: "Draft:fix the build", want: true},
+		{title: "draft:", want: true},
+		{title: "Drafting the release notes", want: false},
+		{title: "Fix WIP", want: false},
+		{title: "do not merge: fix", titles: []string{"DO NOT MERGE"}, want: true},
+		{title: "WIP fix the build", titles: []string{"DO NOT MERGE"}, want: false},
+		{title: "WIP fix the build", titles: []string{}, want: false},
+	}
+	for _, test := range tests {
+		pr := models.GenericResponse{Title: test.title, Draft: test.draft}
+		if got := isDraft(pr, test.titles); got != test.want {
+			t.Errorf("isDraft(%q, draft %t, %q) = %t, want %t", test.title, test.draft, test.titles, got, test.want)
+		}
+	}
+}
+
+func TestSkipsCI(t *testing.T) {
+	tests := []struct {
+		message string
+		want    bool
+	}{
+		{message: "Fix the build [skip ci]", want: true},
+		{message: "[CI SKIP] update docs", want: true},
+		{message: "Update docs\n\n[skip ci]", want: true},
+		{message: "skip ci", want: false},
+		{message: "Fix the build", want: false},
+	}
+	for _, test := range tests {
+		if got := skipsCI(models.Commit{Message: test.message}); got != test.want {
+			t.Errorf("skipsCI(%q) = %t, want %t", test.message, got, test.want)
+		}
+	}
+}
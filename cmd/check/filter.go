@@ -0,0 +1,177 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// filter holds the compiled include and exclude patterns from the source configuration.
+type filter struct {
+	destinationBranches       []*regexp.Regexp
+	ignoreDestinationBranches []*regexp.Regexp
+	sourceBranches            []*regexp.Regexp
+	ignoreSourceBranches      []*regexp.Regexp
+	paths                     []*regexp.Regexp
+	ignorePaths               []*regexp.Regexp
+}
+
+// newFilter compiles the patterns configured in source, failing on the first invalid one.
+func newFilter(source models.Source) (*filter, error) {
+	var f filter
+	var err error
+	if f.destinationBranches, err = compilePatterns(source.DestinationBranches); err != nil {
+		return nil, errors.Wrap(err, "invalid destination_branches")
+	}
+	if f.ignoreDestinationBranches, err = compilePatterns(source.IgnoreDestinationBranches); err != nil {
+		return nil, errors.Wrap(err, "invalid ignore_destination_branches")
+	}
+	if f.sourceBranches, err = compilePatterns(source.SourceBranches); err != nil {
+		return nil, errors.Wrap(err, "invalid source_branches")
+	}
+	if f.ignoreSourceBranches, err = compilePatterns(source.IgnoreSourceBranches); err != nil {
+		return nil, errors.Wrap(err, "invalid ignore_source_branches")
+	}
+	if f.paths, err = compilePathPatterns(source.Paths); err != nil {
+		return nil, errors.Wrap(err, "invalid paths")
+	}
+	if f.ignorePaths, err = compilePathPatterns(source.IgnorePaths); err != nil {
+		return nil, errors.Wrap(err, "invalid ignore_paths")
+	}
+	return &f, nil
+}
+
+// branchesMatch reports whether both the destination and source branch of a pull request are wanted.
+func (f *filter) branchesMatch(pr models.GenericResponse) bool {
+	return included(pr.Destination.Branch.Name, f.destinationBranches, f.ignoreDestinationBranches) &&
+		included(pr.Source.Branch.Name, f.sourceBranches, f.ignoreSourceBranches)
+}
+
+// filtersPaths reports whether paths or ignore_paths are configured, in which case
+// the changed files of every pull request have to be fetched.
+func (f *filter) filtersPaths() bool {
+	return len(f.paths) > 0 || len(f.ignorePaths) > 0
+}
+
+// pathsMatch reports whether at least one changed file is matched by paths and not by ignore_paths.
+// A pattern matching a directory also matches everything below it.
+func (f *filter) pathsMatch(changed []string) bool {
+	for _, file := range changed {
+		if (len(f.paths) == 0 || matchesPath(f.paths, file)) && !matchesPath(f.ignorePaths, file) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPath(patterns []*regexp.Regexp, file string) bool {
+	for dir := file; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if matchesAny(patterns, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// included reports whether s matches one of include (when any are given) and none of exclude.
+func included(s string, include, exclude []*regexp.Regexp) bool {
+	if len(include) > 0 && !matchesAny(include, s) {
+		return false
+	}
+	return !matchesAny(exclude, s)
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePatterns compiles a list of glob patterns. A pattern wrapped in slashes,
+// such as `/^release-[0-9]+$/`, is taken as a regular expression instead.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, p := range patterns {
+		expr := globToRegexp(p)
+		if isRegexp(p) {
+			expr = p[1 : len(p)-1]
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to compile pattern %q", p)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func isRegexp(pattern string) bool {
+	return len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// compilePathPatterns compiles path patterns the way gitignore reads them: a trailing `/` is dropped, a
+// leading `/` anchors the glob to the root of the repository, and a glob without any other `/`, such as
+// `*.md`, matches a file or directory of that name at any depth.
+func compilePathPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	globs := make([]string, len(patterns))
+	for i, p := range patterns {
+		if !isRegexp(p) {
+			p = strings.TrimSuffix(p, "/")
+			if strings.HasPrefix(p, "/") {
+				p = strings.TrimPrefix(p, "/")
+			} else if !strings.Contains(p, "/") {
+				p = "**/" + p
+			}
+		}
+		globs[i] = p
+	}
+	return compilePatterns(globs)
+}
+
+// globToRegexp translates a glob into an anchored regular expression. `*` and `?` do not
+// cross a `/`, `**` matches across directories and `[...]` is kept as a character class.
+func globToRegexp(glob string) string {
+	expr := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				// "**/" also matches no directory at all.
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					expr += "(.*/)?"
+				} else {
+					expr += ".*"
+				}
+			} else {
+				expr += "[^/]*"
+			}
+		case '?':
+			expr += "[^/]"
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				expr += regexp.QuoteMeta(glob[i:])
+				i = len(glob)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + class + "]"
+			i += end
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	return expr + "$"
+}
@@ -0,0 +1,166 @@
+package main
+
+import "testing"
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		match []string
+		miss  []string
+	}{
+		{
+			glob:  "master",
+			match: []string{"master"},
+			miss:  []string{"master2", "old-master"},
+		},
+		{
+			glob:  "feature/*",
+			match: []string{"feature/login", "feature/"},
+			miss:  []string{"feature/login/form", "feature"},
+		},
+		{
+			glob:  "release-?",
+			match: []string{"release-1"},
+			miss:  []string{"release-10", "release-/"},
+		},
+		{
+			glob:  "services/**",
+			match: []string{"services/api", "services/api/main.go"},
+			miss:  []string{"services", "other/services/api"},
+		},
+		{
+			glob:  "**/*.go",
+			match: []string{"main.go", "cmd/check/main.go"},
+			miss:  []string{"main.go.orig"},
+		},
+		{
+			glob:  "docs/**/index.md",
+			match: []string{"docs/index.md", "docs/api/v1/index.md"},
+			miss:  []string{"docs-index.md"},
+		},
+		{
+			glob:  "release-[0-9]",
+			match: []string{"release-1"},
+			miss:  []string{"release-x"},
+		},
+		{
+			glob:  "[!.]*",
+			match: []string{"README.md"},
+			miss:  []string{".gitignore"},
+		},
+		{
+			glob:  "a.b+c(d)",
+			match: []string{"a.b+c(d)"},
+			miss:  []string{"axb+c(d)", "a.bbc(d)"},
+		},
+		{
+			glob:  "[unclosed",
+			match: []string{"[unclosed"},
+			miss:  []string{"u"},
+		},
+	}
+	for _, test := range tests {
+		patterns, err := compilePatterns([]string{test.glob})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.glob, err)
+			continue
+		}
+		for _, s := range test.match {
+			if !matchesAny(patterns, s) {
+				t.Errorf("%q (%s) does not match %q", test.glob, patterns[0], s)
+			}
+		}
+		for _, s := range test.miss {
+			if matchesAny(patterns, s) {
+				t.Errorf("%q (%s) matches %q", test.glob, patterns[0], s)
+			}
+		}
+	}
+}
+
+func TestCompilePatternsRegexp(t *testing.T) {
+	patterns, err := compilePatterns([]string{"/^hotfix-[0-9]+$/"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !matchesAny(patterns, "hotfix-12") || matchesAny(patterns, "hotfix-x") {
+		t.Errorf("pattern %s is not used as a regular expression", patterns[0])
+	}
+
+	if _, err := compilePatterns([]string{"/(/"}); err == nil {
+		t.Error("expected an error for an invalid regular expression")
+	}
+}
+
+func TestMatchesPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		file    string
+		want    bool
+	}{
+		{pattern: "*.md", file: "README.md", want: true},
+		{pattern: "*.md", file: "docs/x.md", want: true},
+		{pattern: "*.md", file: "sub/README.md", want: true},
+		{pattern: "*.md", file: "main.go", want: false},
+		{pattern: "docs", file: "docs/setup/install.md", want: true},
+		{pattern: "docs", file: "services/docs/api.md", want: true},
+		{pattern: "docs/*.md", file: "docs/x.md", want: true},
+		{pattern: "docs/*.md", file: "sub/docs/x.md", want: false},
+		{pattern: "services/api", file: "services/api/main.go", want: true},
+		{pattern: "services/api", file: "services/apis/main.go", want: false},
+		{pattern: "services/**", file: "services/api/main.go", want: true},
+		{pattern: "docs/", file: "docs/x.md", want: true},
+		{pattern: "docs/", file: "sub/docs/x.md", want: true},
+		{pattern: "/services/api", file: "services/api/main.go", want: true},
+		{pattern: "/services/api", file: "other/services/api/main.go", want: false},
+		{pattern: "/*.md", file: "README.md", want: true},
+		{pattern: "/*.md", file: "sub/README.md", want: false},
+		{pattern: "/docs/", file: "docs/x.md", want: true},
+		{pattern: "/\\.md$/", file: "sub/README.md", want: true},
+	}
+	for _, test := range tests {
+		patterns, err := compilePathPatterns([]string{test.pattern})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.pattern, err)
+			continue
+		}
+		if got := matchesPath(patterns, test.file); got != test.want {
+			t.Errorf("%q matching %q = %t, want %t", test.pattern, test.file, got, test.want)
+		}
+	}
+}
+
+func TestPathsMatch(t *testing.T) {
+	f := &filter{}
+	var err error
+	if f.paths, err = compilePathPatterns([]string{"services/**"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.ignorePaths, err = compilePathPatterns([]string{"**/*_test.go"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		changed []string
+		want    bool
+	}{
+		{changed: []string{"services/api/main.go"}, want: true},
+		{changed: []string{"services/api/main_test.go"}, want: false},
+		{changed: []string{"services/api/main_test.go", "services/api/main.go"}, want: true},
+		{changed: []string{"docs/x.md"}, want: false},
+		{changed: nil, want: false},
+	}
+	for _, test := range tests {
+		if got := f.pathsMatch(test.changed); got != test.want {
+			t.Errorf("pathsMatch(%q) = %t, want %t", test.changed, got, test.want)
+		}
+	}
+
+	f = &filter{}
+	if f.ignorePaths, err = compilePathPatterns([]string{"docs/**", "*.md"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.pathsMatch([]string{"docs/x.md", "sub/README.md"}) {
+		t.Error("pull request changing only ignored files is matched")
+	}
+}
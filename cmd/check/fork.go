@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// Fork policies, selected with `fork_policy`.
+const (
+	forkBuild    = "build"
+	forkSkip     = "skip"
+	forkApproval = "approval"
+)
+
+// forkPolicy decides whether pull requests from forks are built.
+type forkPolicy struct {
+	policy  string
+	client  *bitbucket.Client
+	trusted *authorizer
+}
+
+func newForkPolicy(client *bitbucket.Client, source models.Source) (*forkPolicy, error) {
+	policy := source.ForkPolicy
+	if policy == "" {
+		policy = forkBuild
+	}
+	if policy != forkBuild && policy != forkSkip && policy != forkApproval {
+		return nil, errors.Errorf("unknown fork_policy %q, must be one of %q, %q or %q", source.ForkPolicy, forkBuild, forkSkip, forkApproval)
+	}
+
+	trusted, err := newAuthorizer(client, "trusted", source.TrustedUsers, source.TrustedPermission)
+	if err != nil {
+		return nil, err
+	}
+	if policy == forkApproval && !trusted.configured() {
+		return nil, errors.Errorf("fork_policy %q requires trusted_users or trusted_permission", forkApproval)
+	}
+	return &forkPolicy{policy: policy, client: client, trusted: trusted}, nil
+}
+
+// needsApproval reports whether allows looks at the approvals of a pull request, which requires its participants.
+func (f *forkPolicy) needsApproval(pr models.GenericResponse) bool {
+	return f.policy == forkApproval && bitbucket.IsFork(pr)
+}
+
+// allows reports whether a pull request may be built. Pull requests from forks may, depending on the policy, only
+// once a trusted user approved their current commit, so every new commit pushed to the fork needs approving again.
+// When needsApproval, pr must be fetched on its own, as listed pull requests may lack their participants.
+func (f *forkPolicy) allows(ctx context.Context, pr models.GenericResponse) (bool, error) {
+	if f.policy == forkBuild || !bitbucket.IsFork(pr) {
+		return true, nil
+	}
+	if f.policy == forkSkip {
+		log.Printf("Skipping pull request #%d from fork %s", pr.ID, pr.Source.Repository.FullName)
+		return false, nil
+	}
+
+	approvers, err := f.client.GetApprovers(ctx, pr)
+	if err != nil {
+		return false, err
+	}
+	for _, approver := range approvers {
+		trusted, _, err := f.trusted.authorize(ctx, approver)
+		if err != nil {
+			return false, err
+		}
+		if trusted {
+			return true, nil
+		}
+	}
+	log.Printf("Skipping pull request #%d from fork %s until a trusted user approves %s", pr.ID, pr.Source.Repository.FullName, pr.Source.Commit.Hash)
+	return false, nil
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
 	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
@@ -17,36 +21,112 @@ func main() {
 	err := json.NewDecoder(os.Stdin).Decode(&request)
 	check(err)
 
-	token, err := bitbucket.RequestToken(request.Source.Key, request.Source.Secret)
+	filter, err := newFilter(request.Source)
+	check(err)
+
+	statusKeys := request.Source.StatusKeys
+	if len(statusKeys) == 0 && request.Source.StatusKey != "" {
+		statusKeys = []string{request.Source.StatusKey}
+	}
+	staleTimeout, err := parseStaleTimeout(request.Source)
+	check(err)
+	if staleTimeout > 0 && len(statusKeys) == 0 {
+		// Without explicit keys, statuses of other jobs and Concourse instances would be stopped too.
+		check(errors.New("stale_timeout requires status_key or status_keys"))
+	}
+
+	timeout, err := bitbucket.Timeout(request.Source)
+	check(err)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client, err := bitbucket.NewClient(ctx, request.Source)
+	check(err)
+
+	out, err := client.GetPullRequests(ctx)
+	check(err)
+
+	authorizer, err := newAuthorizer(client, "command", request.Source.CommandUsers, request.Source.CommandPermission)
 	check(err)
 
-	out, err := bitbucket.GetPullRequests(request.Source.URL, token, request.Source.APIVersion, request.Source.Team, request.Source.Repo)
+	forks, err := newForkPolicy(client, request.Source)
 	check(err)
 
 	counter := 0
 	for counter < 1 {
 		for _, pr := range *out {
 
-			state, err := bitbucket.GetCommitStatus(pr.Source.Commit.Links.Self.Href, token)
+			if !filter.branchesMatch(pr) {
+				continue
+			}
+
+			if !request.Source.BuildDrafts && isDraft(pr, request.Source.DraftTitles) {
+				log.Printf("Skipping draft pull request #%d: %s", pr.ID, pr.Title)
+				continue
+			}
+
+			if filter.filtersPaths() {
+				changed, err := client.GetChangedPaths(ctx, pr)
+				check(err)
+				if !filter.pathsMatch(changed) {
+					continue
+				}
+			}
+
+			if !request.Source.IgnoreSkipCI {
+				commit, err := client.GetSourceCommit(ctx, pr)
+				check(err)
+				if skipsCI(*commit) {
+					log.Printf("Skipping pull request #%d, commit %s asks to skip CI", pr.ID, pr.Source.Commit.Hash)
+					continue
+				}
+			}
+
+			// Listed pull requests may lack their participants, which the fork policy and reviews look at.
+			full := &pr
+			if forks.needsApproval(pr) || reviewsRequired(request.Source) {
+				full, err = client.GetPullRequestByID(ctx, strconv.Itoa(pr.ID))
+				check(err)
+			}
+
+			allowed, err := forks.allows(ctx, *full)
 			check(err)
+			if !allowed {
+				continue
+			}
+
+			if reviewsRequired(request.Source) {
+				if ok, reason := reviewed(*full, request.Source); !ok {
+					log.Printf("Skipping pull request #%d until reviewed: %s", pr.ID, reason)
+					continue
+				}
+			}
+
+			statuses, err := client.GetCommitStatuses(ctx, pr.Source.Commit.Hash)
+			check(err)
+			stale, err := reapStale(ctx, client, pr.Source.Commit.Hash, statuses, statusKeys, staleTimeout)
+			check(err)
+			state := commitState(statuses, statusKeys)
+			if len(statusKeys) == 0 {
+				warnSharedKeys(pr.Source.Commit.Hash, statuses)
+			}
 
 			link := pr.Links.HTML.Href
+			var issued *command
 
 			if pr.CommentCount > 0 {
-				comments, err := bitbucket.GetPrComments(pr.Links.Comments.Href, token)
+				comments, err := client.GetPrComments(ctx, pr)
 				check(err)
 
-				for _, comment := range comments {
-
-					possibleCommand := strings.Split(comment.Content.Raw, "\n")[0]
-
-					// If the first line of the comment is "/retest", then include this link
-					// in the output, instead of the default PR link. This should trigger
-					// a new build.
-					if possibleCommand == "/retest" {
-						link = comment.Link
-					}
+				// Commands are picked up until a build of the commit reports a status under one of our keys.
+				var since time.Time
+				if latest := latestStatus(statuses, statusKeys); latest != nil {
+					since = latest.UpdatedOn
 				}
+				issued, err = findCommand(comments, request.Source.Commands, since, func(user models.Author) (bool, string, error) {
+					return authorizer.authorize(ctx, user)
+				})
+				check(err)
 			}
 
 			responseOut := models.Version{
@@ -54,6 +134,16 @@ func main() {
 				PullRequest: strconv.Itoa(pr.ID),
 				Link:        link,
 			}
+			if issued != nil {
+				// The link of the comment makes a new version, which triggers a build.
+				responseOut.Link = issued.Link
+				responseOut.Command = issued.Name
+				responseOut.Arguments = issued.Arguments
+			}
+			if stale != "" {
+				// A new version, so that the pull request gets built again.
+				responseOut.Stale = stale
+			}
 
 			switch state {
 			case "SUCCESSFUL":
@@ -79,6 +169,63 @@ func main() {
 	check(err)
 }
 
+// commitState returns the state of the most recently updated status reported by this resource, or "none".
+// Statuses are recognised by their key, which must be one of keys when configured and otherwise carry
+// the prefix of the keys set by in and out. Statuses from other CI systems are ignored.
+func commitState(statuses []models.CommitStatus, keys []string) string {
+	latest := latestStatus(statuses, keys)
+	if latest == nil {
+		return "none"
+	}
+	return latest.State
+}
+
+// latestStatus returns the most recently updated status reported by this resource, or nil.
+func latestStatus(statuses []models.CommitStatus, keys []string) *models.CommitStatus {
+	var latest *models.CommitStatus
+	for i, status := range statuses {
+		if !ours(status, keys) {
+			continue
+		}
+		if latest == nil || status.UpdatedOn.After(latest.UpdatedOn) {
+			latest = &statuses[i]
+		}
+	}
+	return latest
+}
+
+// warnSharedKeys warns when several Concourse jobs report statuses against a commit. Without status_key or
+// status_keys, check cannot tell which of them belong to this pipeline and takes the latest of them all.
+func warnSharedKeys(commit string, statuses []models.CommitStatus) {
+	var keys []string
+	for _, status := range statuses {
+		if strings.HasPrefix(status.Key, bitbucket.StatusKeyPrefix) && !contains(keys, status.Key) {
+			keys = append(keys, status.Key)
+		}
+	}
+	if len(keys) > 1 {
+		log.Printf("warning: commit %s has statuses from several Concourse jobs (%s), set status_key or status_keys to only consider this one",
+			commit, strings.Join(keys, ", "))
+	}
+}
+
+// ours reports whether a status was set by this resource, see commitState.
+func ours(status models.CommitStatus, keys []string) bool {
+	if len(keys) > 0 {
+		return contains(keys, status.Key)
+	}
+	return strings.HasPrefix(status.Key, bitbucket.StatusKeyPrefix)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatalf("%+v", err)
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+func TestLatestStatus(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	statuses := []models.CommitStatus{
+		{Key: "concourse-build", State: "SUCCESSFUL", UpdatedOn: start},
+		{Key: "concourse-deploy", State: "INPROGRESS", UpdatedOn: start.Add(2 * time.Minute)},
+		{Key: "sonarqube", State: "FAILED", UpdatedOn: start.Add(3 * time.Minute)},
+	}
+
+	tests := []struct {
+		keys []string
+		want string
+	}{
+		{keys: nil, want: "concourse-deploy"},
+		{keys: []string{"concourse-build"}, want: "concourse-build"},
+		{keys: []string{"sonarqube"}, want: "sonarqube"},
+		{keys: []string{"concourse-test"}, want: ""},
+	}
+	for _, test := range tests {
+		var got string
+		if latest := latestStatus(statuses, test.keys); latest != nil {
+			got = latest.Key
+		}
+		if got != test.want {
+			t.Errorf("latest status with keys %q is %q, want %q", test.keys, got, test.want)
+		}
+	}
+
+	if state := commitState(statuses, []string{"concourse-test"}); state != "none" {
+		t.Errorf("got state %q without any status of ours, want none", state)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// reviewsRequired reports whether the source holds pull requests back until they are reviewed.
+func reviewsRequired(source models.Source) bool {
+	return source.MinApprovals > 0 || len(source.RequiredReviewers) > 0 || source.NoChangesRequested
+}
+
+// reviewed reports whether the participants of a pull request satisfy the review requirements of the source,
+// and which one they miss when they do not.
+func reviewed(pr models.GenericResponse, source models.Source) (bool, string) {
+	approvers := map[string]models.Author{}
+	for _, participant := range pr.Participants {
+		id := participant.User.UUID + "/" + participant.User.Username
+		if source.NoChangesRequested && participant.State == "changes_requested" {
+			return false, fmt.Sprintf("%s requested changes", userName(participant.User))
+		}
+		if participant.Approved {
+			approvers[id] = participant.User
+		}
+	}
+
+	if len(approvers) < source.MinApprovals {
+		return false, fmt.Sprintf("%d of %d approvals", len(approvers), source.MinApprovals)
+	}
+
+	var missing []string
+	for _, reviewer := range source.RequiredReviewers {
+		approved := false
+		for _, approver := range approvers {
+			if sameUser(approver, reviewer) {
+				approved = true
+				break
+			}
+		}
+		if !approved {
+			missing = append(missing, reviewer)
+		}
+	}
+	if len(missing) > 0 {
+		return false, "waiting for the approval of " + strings.Join(missing, ", ")
+	}
+	return true, ""
+}
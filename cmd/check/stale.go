@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// parseStaleTimeout returns how long a status may stay in progress before check stops it, as configured with
+// `stale_timeout` in the source. Zero disables the check.
+func parseStaleTimeout(source models.Source) (time.Duration, error) {
+	if source.StaleTimeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(source.StaleTimeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid stale_timeout %q", source.StaleTimeout)
+	}
+	return timeout, nil
+}
+
+// reapStale flips the statuses with one of keys that have been in progress for longer than timeout to stopped,
+// as the build that set them is presumably lost along with its worker. The statuses are updated in place.
+// It returns when the most recent of them was last updated, or an empty string when none was stale.
+func reapStale(ctx context.Context, client *bitbucket.Client, commit string, statuses []models.CommitStatus, keys []string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return "", nil
+	}
+
+	var stale string
+	for i, status := range statuses {
+		if status.State != "INPROGRESS" || !contains(keys, status.Key) {
+			continue
+		}
+		age := time.Since(status.UpdatedOn)
+		if age < timeout {
+			continue
+		}
+
+		age -= age % time.Second
+		description := fmt.Sprintf("In progress for %s without an update, the build was presumably lost", age)
+		log.Printf("Stopping status %s of %s: %s", status.Key, commit, description)
+
+		err := client.SetBuildStatus(ctx, commit, models.OutStatus{
+			State:       "STOPPED",
+			Key:         status.Key,
+			URL:         status.URL,
+			Name:        status.Name,
+			Description: description,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		since := status.UpdatedOn.UTC().Format(time.RFC3339)
+		if since > stale {
+			stale = since
+		}
+		statuses[i].State = "STOPPED"
+		statuses[i].UpdatedOn = time.Now()
+	}
+	return stale, nil
+}
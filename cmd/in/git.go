@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// go-git cannot merge, so the merge preview is built with the git binary shipped in the image.
+
+// runGit runs git with args in dir and returns its trimmed standard output.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=concourse",
+		"GIT_AUTHOR_EMAIL=concourse@localhost",
+		"GIT_COMMITTER_NAME=concourse",
+		"GIT_COMMITTER_EMAIL=concourse@localhost",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "git %s failed: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// fetchFork fetches branch from the fork at url into the clone, under the "fork" remote, so the source commit of a
+// pull request from that fork can be checked out. The fork is read with the credentials of the source.
+func fetchFork(ctx context.Context, r *git.Repository, url, branch string, auth transport.AuthMethod) error {
+	remote, err := r.CreateRemote(&config.RemoteConfig{Name: "fork", URLs: []string{url}})
+	if err != nil {
+		return errors.Wrap(err, "unable to add the fork as a remote")
+	}
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec("+refs/heads/" + branch + ":refs/remotes/fork/" + branch)},
+		Auth:     auth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return errors.Wrapf(err, "unable to fetch branch %s from fork %s", branch, url)
+	}
+	return nil
+}
+
+// resolveCommit expands a possibly abbreviated commit hash, as returned by Bitbucket Cloud, to the full hash.
+// It fails when no branch of the clone contains the commit anymore, typically after a force push.
+func resolveCommit(ctx context.Context, dir, commit string) (string, error) {
+	full, err := runGit(ctx, dir, "rev-parse", "--verify", "--quiet", commit+"^{commit}")
+	if err != nil || full == "" {
+		return "", fmt.Errorf("commit %s is no longer reachable in the repository, it may have been rewritten by a force push", commit)
+	}
+	return full, nil
+}
+
+// mergePreview checks out the destination commit, merges the source commit into it and returns the
+// hash of the resulting merge commit. Conflicts abort the merge and are reported with the files involved.
+func mergePreview(ctx context.Context, dir, destination, source, message string) (string, error) {
+	if _, err := runGit(ctx, dir, "checkout", "--force", "--detach", destination); err != nil {
+		return "", errors.Wrapf(err, "unable to check out destination commit %s", destination)
+	}
+
+	if _, err := runGit(ctx, dir, "merge", "--no-ff", "--no-edit", "-m", message, source); err != nil {
+		conflicts, _ := runGit(ctx, dir, "diff", "--name-only", "--diff-filter=U")
+		runGit(ctx, dir, "merge", "--abort")
+		if conflicts != "" {
+			return "", fmt.Errorf("merging %s into %s conflicts in:\n%s", source, destination, conflicts)
+		}
+		return "", errors.Wrapf(err, "unable to merge %s into %s", source, destination)
+	}
+
+	return runGit(ctx, dir, "rev-parse", "HEAD")
+}
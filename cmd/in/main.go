@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 
 	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 
 	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
 	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
@@ -29,13 +31,27 @@ func main() {
 		return
 	}
 
-	token, err := bitbucket.RequestToken(request.Source.Key, request.Source.Secret)
+	timeout, err := bitbucket.Timeout(request.Source)
 	check(err)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	out, err := bitbucket.GetPullRequestByID(request.Source.URL, token, request.Source.APIVersion, request.Source.Team, request.Source.Repo, request.Version.PullRequest)
+	client, err := bitbucket.NewClient(ctx, request.Source)
 	check(err)
 
-	err = bitbucket.SetBuildStatus(request.Source.URL, token, request.Source.APIVersion, request.Source.Team, request.Source.Repo, out.Source.Commit.Hash, "INPROGRESS", request.Source.ConcourseURL)
+	out, err := client.GetPullRequestByID(ctx, request.Version.PullRequest)
+	check(err)
+
+	if !strings.HasPrefix(out.Source.Commit.Hash, request.Version.Commit) && !strings.HasPrefix(request.Version.Commit, out.Source.Commit.Hash) {
+		log.Printf("Pull request #%s has moved on to %s, fetching version %s", request.Version.PullRequest, out.Source.Commit.Hash, request.Version.Commit)
+	}
+
+	var key string
+	if request.Params.Key != "" {
+		key, err = bitbucket.Render(request.Params.Key, request.Source, *out)
+		check(err)
+	}
+	err = client.SetBuildStatus(ctx, request.Version.Commit, models.OutStatus{State: "INPROGRESS", Key: key})
 	check(err)
 
 	inVersion := request.Version
@@ -44,38 +60,89 @@ func main() {
 
 	outputDir := args[1]
 	versionID := []byte(request.Version.PullRequest)
-	commitID := []byte(string(strings.Replace(out.Source.Commit.Hash, "\n", "", -1)))
 	Branch := []byte(string(strings.Replace(out.Source.Branch.Name, "\n", "", -1)))
 
 	err = os.MkdirAll(outputDir, os.ModePerm)
 	check(err)
 
-	r, err := git.PlainClone(outputDir, false, &git.CloneOptions{
-		URL: "https://x-token-auth:" + token + "@bitbucket.org/" + request.Source.Team + "/" + request.Source.Repo,
+	cloneURL, err := client.CloneURL()
+	check(err)
+
+	// The timeout only bounds the API calls, cloning and merging a large repository may take longer.
+	gitCtx := context.Background()
+
+	username, password := client.GitCredentials()
+	auth := &githttp.BasicAuth{Username: username, Password: password}
+	r, err := git.PlainCloneContext(gitCtx, outputDir, false, &git.CloneOptions{
+		URL:  cloneURL,
+		Auth: auth,
 	})
 	check(err)
 
+	// The source commit of a pull request from a fork only exists in the fork.
+	if bitbucket.IsFork(*out) {
+		forkURL, err := client.RepositoryCloneURL(out.Source.Repository.FullName)
+		check(err)
+		err = fetchFork(gitCtx, r, forkURL, out.Source.Branch.Name, auth)
+		check(err)
+	}
+
+	// Check out the exact commit of the version rather than the branch head, so re-running an old build
+	// tests the same code again.
+	versionCommit, err := resolveCommit(gitCtx, outputDir, request.Version.Commit)
+	check(err)
+
 	w, err := r.Worktree()
+	check(err)
 	err = w.Checkout(&git.CheckoutOptions{
-
-		Branch: plumbing.ReferenceName(fmt.Sprintf("refs/remotes/origin/%s", out.Source.Branch.Name)),
-		Force:  true,
+		Hash:  plumbing.NewHash(versionCommit),
+		Force: true,
 	})
+	check(err)
+
+	head, err := r.Head()
+	check(err)
+	if head.Hash().String() != versionCommit {
+		log.Fatalf("checked out %s instead of version commit %s", head.Hash(), versionCommit)
+	}
+
+	metadata := models.Metadata{}
+
+	if request.Source.MergePreview || request.Params.MergePreview {
+		message := fmt.Sprintf("Merge %s into %s for pull request #%s", out.Source.Branch.Name, out.Destination.Branch.Name, request.Version.PullRequest)
+		mergeCommit, err := mergePreview(gitCtx, outputDir, out.Destination.Commit.Hash, versionCommit, message)
+		check(err)
+
+		err = ioutil.WriteFile(outputDir+"/merge_commit", []byte(mergeCommit), 0644)
+		check(err)
+
+		metadata = append(metadata, models.MetadataField{Name: "MergeCommit", Value: mergeCommit})
+	}
 
 	err = ioutil.WriteFile(outputDir+"/version", versionID, 0644)
 	check(err)
 
-	err = ioutil.WriteFile(outputDir+"/commit", commitID, 0644)
+	err = ioutil.WriteFile(outputDir+"/commit", []byte(versionCommit), 0644)
 	check(err)
 
 	err = ioutil.WriteFile(outputDir+"/branch", Branch, 0644)
 	check(err)
 
+	if request.Version.Command != "" {
+		err = ioutil.WriteFile(outputDir+"/command", []byte(request.Version.Command), 0644)
+		check(err)
+
+		err = ioutil.WriteFile(outputDir+"/arguments", []byte(request.Version.Arguments), 0644)
+		check(err)
+
+		metadata = append(metadata, models.MetadataField{Name: "Command", Value: strings.TrimSpace(request.Version.Command + " " + request.Version.Arguments)})
+	}
+
 	version := models.MetadataField{Name: "Version", Value: request.Version.Commit}
 	author := models.MetadataField{Name: "Author", Value: out.Author.DisplayName}
 	branch := models.MetadataField{Name: "Branch", Value: out.Source.Branch.Name}
-	commit := models.MetadataField{Name: "Commit", Value: out.Source.Commit.Hash}
-	metadata := models.Metadata{version, author, branch, commit}
+	commit := models.MetadataField{Name: "Commit", Value: versionCommit}
+	metadata = append(models.Metadata{version, author, branch, commit}, metadata...)
 
 	err = json.NewEncoder(os.Stdout).Encode(models.InResponse{Version: inVersion, Metadata: metadata})
 	check(err)
@@ -16,9 +16,23 @@ type Author struct {
 			Href string `json:"href"`
 		} `json:"self"`
 	} `json:"links,omitempty"`
-	Type     string `json:"type"`
-	Username string `json:"username"`
-	UUID     string `json:"uuid"`
+	Type      string `json:"type"`
+	Username  string `json:"username"`
+	Nickname  string `json:"nickname"`
+	AccountID string `json:"account_id"`
+	UUID      string `json:"uuid"`
+}
+
+// Participant is a reviewer or participant of a pull request.
+type Participant struct {
+	Approved bool   `json:"approved"`
+	Role     string `json:"role"`
+	// State is "approved", "changes_requested" or empty.
+	State string `json:"state"`
+	Type  string `json:"type"`
+	User  Author `json:"user"`
+	// LastReviewedCommit is only known on Bitbucket Server.
+	LastReviewedCommit string `json:"last_reviewed_commit,omitempty"`
 }
 
 // Links is the structure of links and references attached to many Bitbucket API responses.
@@ -44,6 +58,9 @@ type Links struct {
 	Diff struct {
 		Href string `json:"href"`
 	} `json:"diff"`
+	Diffstat struct {
+		Href string `json:"href"`
+	} `json:"diffstat"`
 	HTML struct {
 		Href string `json:"href"`
 	} `json:"html"`
@@ -75,7 +92,9 @@ type GenericResponse struct {
 	CommentCount      int            `json:"comment_count,omitempty"`
 	Content           CommentContent `json:"content,omitempty"`
 	CreatedOn         time.Time      `json:"created_on"`
+	Deleted           bool           `json:"deleted,omitempty"`
 	Description       string         `json:"description"`
+	Draft             bool           `json:"draft,omitempty"`
 	Destination       struct {
 		Branch struct {
 			Name string `json:"name,omitempty"`
@@ -95,35 +114,21 @@ type GenericResponse struct {
 	ID     int `json:"id"`
 	Inline *struct {
 		Path string `json:"path,omitempty"`
+		To   int    `json:"to,omitempty"`
 	} `json:"inline,omitempty"`
 	Links       Links       `json:"links,omitempty"`
 	MergeCommit interface{} `json:"merge_commit,omitempty"`
-	Parent      *struct {
+	New         *struct {
+		Path string `json:"path,omitempty"`
+	} `json:"new,omitempty"`
+	Old *struct {
+		Path string `json:"path,omitempty"`
+	} `json:"old,omitempty"`
+	Parent *struct {
 		ID int `json:"id,omitempty"`
 	} `json:"parent,omitempty"`
-	Participants []struct {
-		Approved bool   `json:"approved"`
-		Role     string `json:"role"`
-		Type     string `json:"type"`
-		User     struct {
-			DisplayName string `json:"display_name"`
-			Links       struct {
-				Avatar struct {
-					Href string `json:"href"`
-				} `json:"avatar"`
-				HTML struct {
-					Href string `json:"href"`
-				} `json:"html"`
-				Self struct {
-					Href string `json:"href"`
-				} `json:"self"`
-			} `json:"links"`
-			Type     string `json:"type"`
-			Username string `json:"username"`
-			UUID     string `json:"uuid"`
-		} `json:"user"`
-	} `json:"participants"`
-	Pullrequest struct {
+	Participants []Participant `json:"participants"`
+	Pullrequest  struct {
 		Type  string `json:"type,omitempty"`
 		ID    int    `json:"id,omitempty"`
 		Links Links  `json:"links,omitempty"`
@@ -146,6 +151,7 @@ type GenericResponse struct {
 		} `json:"repository,omitempty"`
 	} `json:"source,omitempty"`
 	State     string    `json:"state,omitempty"`
+	Status    string    `json:"status,omitempty"`
 	TaskCount int       `json:"task_count,omitempty"`
 	Title     string    `json:"title,omitempty"`
 	Type      string    `json:"type,omitempty"`
@@ -167,17 +173,108 @@ type Params struct {
 	State       string `json:"state"`
 	PullRequest string `json:"pull_request"`
 	Commit      string `json:"commit"`
+	// Key, Name, Description and Refname complete the build status, they are templated like comments.
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Refname     string `json:"refname"`
+	Comment     string `json:"comment"`
+	CommentFile string `json:"comment_file"`
+	// StickyComment keeps a single comment per job up to date, either by editing or by re-creating it.
+	StickyComment          string `json:"sticky_comment"`
+	DeleteCommentOnSuccess bool   `json:"delete_comment_on_success"`
+	Action                 string `json:"action"`
+	MergeStrategy          string `json:"merge_strategy"`
+	MergeMessage           string `json:"merge_message"`
+	CloseSourceBranch      bool   `json:"close_source_branch"`
+
+	Report *ReportParams `json:"report"`
+	// JUnit is a glob of JUnit XML files in the input directory, summarised into a test report.
+	JUnit string `json:"junit"`
+
+	Findings *FindingsParams `json:"findings"`
+}
+
+// FindingsParams configures how "out" reports the findings of static analysis tools.
+type FindingsParams struct {
+	// Files is a glob of SARIF or checkstyle reports in the input directory.
+	Files  string `json:"files"`
+	Format string `json:"format"`
+	// Threshold is the lowest severity failing the report.
+	Threshold string `json:"threshold"`
+	// Mode is either "annotations", for a Code Insights report, or "comments", for inline pull request comments.
+	Mode        string `json:"mode"`
+	Key         string `json:"key"`
+	Title       string `json:"title"`
+	StripPrefix string `json:"strip_prefix"`
+}
+
+// ReportParams configures the Code Insights report published by "out".
+type ReportParams struct {
+	Key     string       `json:"key"`
+	Title   string       `json:"title"`
+	Details string       `json:"details"`
+	Type    string       `json:"type"`
+	Result  string       `json:"result"`
+	Link    string       `json:"link"`
+	Data    []ReportData `json:"data"`
+	// Annotations is a file in the input directory holding a JSON list of Annotation.
+	Annotations string `json:"annotations"`
 }
 
 // Source ... (referenced from CheckRequest)
 type Source struct {
+	Flavour      string `json:"flavour"`
 	Repo         string `json:"repo"`
 	Secret       string `json:"secret"`
 	Key          string `json:"key"`
+	TokenURL     string `json:"token_url"`
+	Token        string `json:"token"`
+	Username     string `json:"username"`
+	AppPassword  string `json:"app_password"`
 	Team         string `json:"team"`
 	URL          string `json:"url"`
 	APIVersion   string `json:"version"`
 	ConcourseURL string `json:"concourse_url"`
+	Timeout      string `json:"timeout"`
+	MergePreview bool   `json:"merge_preview"`
+	MaxRetries   *int   `json:"max_retries"`
+	MaxBackoff   string `json:"max_backoff"`
+	RetryBudget  string `json:"retry_budget"`
+
+	DestinationBranches       []string `json:"destination_branches"`
+	IgnoreDestinationBranches []string `json:"ignore_destination_branches"`
+	SourceBranches            []string `json:"source_branches"`
+	IgnoreSourceBranches      []string `json:"ignore_source_branches"`
+
+	Paths       []string `json:"paths"`
+	IgnorePaths []string `json:"ignore_paths"`
+
+	StatusKeys []string `json:"status_keys"`
+	StatusKey  string   `json:"status_key"`
+
+	StaleTimeout string `json:"stale_timeout"`
+
+	Commands []string `json:"commands"`
+	// CommandUsers and CommandPermission restrict who may issue commands, when either is set.
+	CommandUsers      []string `json:"command_users"`
+	CommandPermission string   `json:"command_permission"`
+
+	// ForkPolicy is one of "build", "skip" or "approval", the latter building pull requests from forks once a
+	// trusted user approved their current commit.
+	ForkPolicy        string   `json:"fork_policy"`
+	TrustedUsers      []string `json:"trusted_users"`
+	TrustedPermission string   `json:"trusted_permission"`
+
+	// MinApprovals, RequiredReviewers and NoChangesRequested hold pull requests back until reviewed.
+	MinApprovals       int      `json:"min_approvals"`
+	RequiredReviewers  []string `json:"required_reviewers"`
+	NoChangesRequested bool     `json:"no_changes_requested"`
+
+	// DraftTitles default to common draft markers, an empty list disables them.
+	DraftTitles  []string `json:"draft_titles"`
+	BuildDrafts  bool     `json:"build_drafts"`
+	IgnoreSkipCI bool     `json:"ignore_skip_ci"`
 }
 
 // Version ... (referenced from CheckRequest)
@@ -185,12 +282,25 @@ type Version struct {
 	Commit      string `json:"commit"`
 	PullRequest string `json:"pullrequest"`
 	Link        string `json:"link,omitempty"`
+	// Stale tells apart the version emitted after a lost build was stopped, so that it runs again.
+	Stale string `json:"stale,omitempty"`
+	// Command and Arguments hold the comment command that triggered the version, if any.
+	Command   string `json:"command,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
 }
 
 // InRequest is the struct/JSON supplied as input to "in" - Concourse pipeline "get"
 type InRequest struct {
-	Source  Source  `json:"source"`
-	Version Version `json:"version"`
+	Params  InParams `json:"params"`
+	Source  Source   `json:"source"`
+	Version Version  `json:"version"`
+}
+
+// InParams ... (referenced from InRequest)
+type InParams struct {
+	MergePreview bool `json:"merge_preview"`
+	// Key of the INPROGRESS status, templated like out params. It must match the key given to out.
+	Key string `json:"key"`
 }
 
 // InResponse is the struct/JSON that is output from "in".
@@ -223,15 +333,79 @@ type OutResponse struct {
 
 // OutStatus holds data about a build's status.
 type OutStatus struct {
-	State string `json:"state"`
-	Key   string `json:"key"`
-	URL   string `json:"url"`
+	State       string `json:"state"`
+	Key         string `json:"key"`
+	URL         string `json:"url"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Refname     string `json:"refname,omitempty"`
+}
+
+// Report is a Code Insights report attached to a commit.
+// <https://developer.atlassian.com/cloud/bitbucket/rest/api-group-reports/>
+type Report struct {
+	Title      string       `json:"title"`
+	Details    string       `json:"details,omitempty"`
+	ReportType string       `json:"report_type,omitempty"`
+	Reporter   string       `json:"reporter,omitempty"`
+	Link       string       `json:"link,omitempty"`
+	Result     string       `json:"result,omitempty"`
+	Data       []ReportData `json:"data,omitempty"`
+}
+
+// ReportData is a single figure shown on a Code Insights report.
+type ReportData struct {
+	Title string      `json:"title"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// Annotation is a finding of a Code Insights report, optionally pointing at a line of a file.
+type Annotation struct {
+	ExternalID     string `json:"external_id,omitempty"`
+	AnnotationType string `json:"annotation_type,omitempty"`
+	Path           string `json:"path,omitempty"`
+	Line           int    `json:"line,omitempty"`
+	Summary        string `json:"summary"`
+	Details        string `json:"details,omitempty"`
+	Severity       string `json:"severity,omitempty"`
+	Result         string `json:"result,omitempty"`
+	Link           string `json:"link,omitempty"`
 }
 
 // type CredentialsRequest2 struct {
 // 	GrantType string `json:"grant_type"`
 // }
 
+// Commit is a commit of a Bitbucket Cloud repository.
+type Commit struct {
+	Hash    string    `json:"hash"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+}
+
+// Activity is an entry of the activity log of a Bitbucket Cloud pull request. Only one of its fields is set.
+type Activity struct {
+	Update *struct {
+		Date   time.Time `json:"date"`
+		Source struct {
+			Commit struct {
+				Hash string `json:"hash"`
+			} `json:"commit"`
+		} `json:"source"`
+	} `json:"update"`
+	Approval *struct {
+		Date time.Time `json:"date"`
+		User Author    `json:"user"`
+	} `json:"approval"`
+}
+
+// RepositoryPermission is the permission of a user on a Bitbucket Cloud repository.
+type RepositoryPermission struct {
+	Permission string `json:"permission"`
+	User       Author `json:"user"`
+}
+
 // Token holds Authentication Tokens for accessing the Bitbucket API.
 type Token struct {
 	AccessToken  string `json:"access_token"`
@@ -244,38 +418,42 @@ type Token struct {
 // CommitResponse represents the Commit Status response from the Bitbucket API.
 // <https://developer.atlassian.com/bitbucket/api/2/reference/resource/repositories/%7Busername%7D/%7Brepo_slug%7D/commit/%7Bnode%7D/statuses>
 type CommitResponse struct {
-	Page    int `json:"page"`
-	Pagelen int `json:"pagelen"`
-	Size    int `json:"size"`
-	Values  []struct {
-		CreatedOn   time.Time   `json:"created_on"`
-		Description string      `json:"description"`
-		Key         string      `json:"key"`
-		Links       Links       `json:"links"`
-		Name        string      `json:"name"`
-		Refname     interface{} `json:"refname"`
-		Repository  struct {
-			FullName string `json:"full_name"`
-			Links    struct {
-				Avatar struct {
-					Href string `json:"href"`
-				} `json:"avatar"`
-				HTML struct {
-					Href string `json:"href"`
-				} `json:"html"`
-				Self struct {
-					Href string `json:"href"`
-				} `json:"self"`
-			} `json:"links"`
-			Name string `json:"name"`
-			Type string `json:"type"`
-			UUID string `json:"uuid"`
-		} `json:"repository"`
-		State     string `json:"state"`
-		Type      string `json:"type"`
-		UpdatedOn string `json:"updated_on"`
-		URL       string `json:"url"`
-	} `json:"values"`
+	Page    int            `json:"page"`
+	Pagelen int            `json:"pagelen"`
+	Size    int            `json:"size"`
+	Next    string         `json:"next"`
+	Values  []CommitStatus `json:"values"`
+}
+
+// CommitStatus is a single build status reported against a commit.
+type CommitStatus struct {
+	CreatedOn   time.Time   `json:"created_on"`
+	Description string      `json:"description"`
+	Key         string      `json:"key"`
+	Links       Links       `json:"links"`
+	Name        string      `json:"name"`
+	Refname     interface{} `json:"refname"`
+	Repository  struct {
+		FullName string `json:"full_name"`
+		Links    struct {
+			Avatar struct {
+				Href string `json:"href"`
+			} `json:"avatar"`
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+			Self struct {
+				Href string `json:"href"`
+			} `json:"self"`
+		} `json:"links"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+		UUID string `json:"uuid"`
+	} `json:"repository"`
+	State     string    `json:"state"`
+	Type      string    `json:"type"`
+	UpdatedOn time.Time `json:"updated_on"`
+	URL       string    `json:"url"`
 }
 
 // CommentContent is the actual text of a comment.
@@ -293,9 +471,26 @@ type Comment struct {
 	User   Author `json:"user"`
 	Inline struct {
 		Path string `json:"path"`
+		To   int    `json:"to"`
 	} `json:"inline"`
 	UpdatedOn time.Time `json:"updated_on"`
 	Type      string    `json:"type"`
 	ID        int       `json:"id"`
 	Link      string
+	// Version is the revision of the comment on Bitbucket Server, which edits and deletes must name.
+	Version int
+}
+
+// ErrorResponse is the body of a failed request. Bitbucket Cloud fills in Error, Bitbucket Server lists Errors.
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error struct {
+		Message string `json:"message"`
+		Detail  string `json:"detail"`
+	} `json:"error"`
+	Errors []struct {
+		Context       string `json:"context"`
+		Message       string `json:"message"`
+		ExceptionName string `json:"exceptionName"`
+	} `json:"errors"`
 }
@@ -0,0 +1,170 @@
+package models
+
+import "encoding/json"
+
+// ServerPagedResponse is a page of a collection returned by the Bitbucket Server REST API.
+// <https://docs.atlassian.com/bitbucket-server/rest/latest/bitbucket-rest.html#paging-params>
+type ServerPagedResponse struct {
+	Size          int               `json:"size"`
+	Limit         int               `json:"limit"`
+	IsLastPage    bool              `json:"isLastPage"`
+	Start         int               `json:"start"`
+	NextPageStart int               `json:"nextPageStart"`
+	Values        []json.RawMessage `json:"values"`
+}
+
+// ServerLinks holds the links attached to Bitbucket Server objects. Unlike Cloud, every link is a list.
+type ServerLinks struct {
+	Self []struct {
+		Href string `json:"href"`
+	} `json:"self"`
+	Clone []struct {
+		Href string `json:"href"`
+		Name string `json:"name"`
+	} `json:"clone"`
+}
+
+// ServerUser is a Bitbucket Server user account.
+type ServerUser struct {
+	Name         string      `json:"name"`
+	EmailAddress string      `json:"emailAddress"`
+	ID           int         `json:"id"`
+	DisplayName  string      `json:"displayName"`
+	Slug         string      `json:"slug"`
+	Type         string      `json:"type"`
+	Links        ServerLinks `json:"links"`
+}
+
+// ServerParticipant is the author, a reviewer or a participant of a Bitbucket Server pull request.
+type ServerParticipant struct {
+	User               ServerUser `json:"user"`
+	Role               string     `json:"role"`
+	Approved           bool       `json:"approved"`
+	Status             string     `json:"status"`
+	LastReviewedCommit string     `json:"lastReviewedCommit"`
+}
+
+// ServerRef is the source or destination of a Bitbucket Server pull request.
+type ServerRef struct {
+	ID           string `json:"id"`
+	DisplayID    string `json:"displayId"`
+	LatestCommit string `json:"latestCommit"`
+	Repository   struct {
+		Slug    string `json:"slug"`
+		Name    string `json:"name"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+		Links ServerLinks `json:"links"`
+	} `json:"repository"`
+}
+
+// ServerPullRequest is a pull request as returned by the Bitbucket Server REST API.
+// <https://docs.atlassian.com/bitbucket-server/rest/latest/bitbucket-rest.html#idp281>
+type ServerPullRequest struct {
+	ID           int                 `json:"id"`
+	Version      int                 `json:"version"`
+	Title        string              `json:"title"`
+	Description  string              `json:"description"`
+	State        string              `json:"state"`
+	Draft        bool                `json:"draft"`
+	CreatedDate  int64               `json:"createdDate"`
+	UpdatedDate  int64               `json:"updatedDate"`
+	FromRef      ServerRef           `json:"fromRef"`
+	ToRef        ServerRef           `json:"toRef"`
+	Author       ServerParticipant   `json:"author"`
+	Reviewers    []ServerParticipant `json:"reviewers"`
+	Participants []ServerParticipant `json:"participants"`
+	Properties   struct {
+		CommentCount  int `json:"commentCount"`
+		OpenTaskCount int `json:"openTaskCount"`
+	} `json:"properties"`
+	Links ServerLinks `json:"links"`
+}
+
+// ServerComment is a comment on a Bitbucket Server pull request.
+type ServerComment struct {
+	ID          int        `json:"id"`
+	Version     int        `json:"version"`
+	Text        string     `json:"text"`
+	Author      ServerUser `json:"author"`
+	CreatedDate int64      `json:"createdDate"`
+	UpdatedDate int64      `json:"updatedDate"`
+}
+
+// ServerActivity is an entry of the activity stream of a Bitbucket Server pull request.
+// Comments are only exposed through this stream.
+type ServerActivity struct {
+	ID            int                  `json:"id"`
+	CreatedDate   int64                `json:"createdDate"`
+	User          ServerUser           `json:"user"`
+	Action        string               `json:"action"`
+	CommentAction string               `json:"commentAction"`
+	Comment       *ServerComment       `json:"comment"`
+	CommentAnchor *ServerCommentAnchor `json:"commentAnchor"`
+}
+
+// ServerCommentAnchor places an inline comment on a line of a file of a Bitbucket Server pull request.
+type ServerCommentAnchor struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line,omitempty"`
+	LineType string `json:"lineType,omitempty"`
+	FileType string `json:"fileType,omitempty"`
+}
+
+// ServerPath is a file path as rendered by the Bitbucket Server REST API.
+type ServerPath struct {
+	ToString string `json:"toString"`
+}
+
+// ServerChange is a file changed by a Bitbucket Server pull request.
+type ServerChange struct {
+	Path    ServerPath  `json:"path"`
+	SrcPath *ServerPath `json:"srcPath"`
+	Type    string      `json:"type"`
+}
+
+// ServerBuildStatus is a build status reported against a commit on Bitbucket Server.
+type ServerBuildStatus struct {
+	State       string `json:"state"`
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+	DateAdded   int64  `json:"dateAdded"`
+}
+
+// ServerReport is a Code Insights report as expected by Bitbucket Server.
+type ServerReport struct {
+	Title    string       `json:"title"`
+	Details  string       `json:"details,omitempty"`
+	Reporter string       `json:"reporter,omitempty"`
+	Link     string       `json:"link,omitempty"`
+	Result   string       `json:"result,omitempty"`
+	Data     []ReportData `json:"data,omitempty"`
+}
+
+// ServerAnnotation is a Code Insights annotation as expected by Bitbucket Server.
+type ServerAnnotation struct {
+	ExternalID string `json:"externalId,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Line       int    `json:"line,omitempty"`
+	Message    string `json:"message"`
+	Severity   string `json:"severity"`
+	Type       string `json:"type,omitempty"`
+	Link       string `json:"link,omitempty"`
+}
+
+// ServerPermission is the permission granted to a user on a Bitbucket Server project or repository.
+type ServerPermission struct {
+	User       ServerUser `json:"user"`
+	Permission string     `json:"permission"`
+}
+
+// ServerCommit is a commit of a Bitbucket Server repository.
+type ServerCommit struct {
+	ID                 string `json:"id"`
+	DisplayID          string `json:"displayId"`
+	Message            string `json:"message"`
+	CommitterTimestamp int64  `json:"committerTimestamp"`
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// Actions out can take on the pull request, selected with the `action` param.
+const (
+	actionApprove        = "approve"
+	actionUnapprove      = "unapprove"
+	actionDecline        = "decline"
+	actionRequestChanges = "request-changes"
+	actionMerge          = "merge"
+)
+
+// runAction reviews, merges or declines a pull request on behalf of the configured user. Approving or requesting
+// changes again is not an error, so rebuilds of the same version succeed.
+func runAction(ctx context.Context, client *bitbucket.Client, request models.OutRequest, pr models.GenericResponse, commit string) error {
+	action := request.Params.Action
+	prID := strconv.Itoa(pr.ID)
+
+	var err error
+	switch action {
+	case actionApprove:
+		_, err = client.ApprovePullRequest(ctx, prID)
+	case actionUnapprove:
+		err = client.UnapprovePullRequest(ctx, prID)
+	case actionDecline:
+		_, err = client.DeclinePullRequest(ctx, prID)
+	case actionRequestChanges:
+		err = client.RequestChanges(ctx, prID)
+	case actionMerge:
+		return merge(ctx, client, request, pr, commit)
+	default:
+		return errors.Errorf("unknown action %q, must be one of %q, %q, %q, %q or %q",
+			action, actionApprove, actionUnapprove, actionDecline, actionRequestChanges, actionMerge)
+	}
+	if bitbucket.IsConflict(err) && action != actionDecline {
+		log.Printf("Pull request #%s is already in the requested state: %v", prID, err)
+		return nil
+	}
+	return err
+}
+
+// merge merges the pull request, refusing to do so when its source branch moved on from the commit that was built.
+func merge(ctx context.Context, client *bitbucket.Client, request models.OutRequest, pr models.GenericResponse, commit string) error {
+	head := pr.Source.Commit.Hash
+	if commit == "" || head == "" || !(strings.HasPrefix(commit, head) || strings.HasPrefix(head, commit)) {
+		return errors.Errorf("refusing to merge pull request #%d, its source commit %s is not the built commit %s", pr.ID, head, commit)
+	}
+
+	var message string
+	if request.Params.MergeMessage != "" {
+		var err error
+		message, err = bitbucket.Render(request.Params.MergeMessage, request.Source, pr)
+		if err != nil {
+			return err
+		}
+	}
+
+	merged, err := client.MergePullRequest(ctx, pr, request.Params.MergeStrategy, message, request.Params.CloseSourceBranch)
+	if err != nil {
+		return err
+	}
+	log.Printf("Merged pull request #%d into %s, state %s", pr.ID, pr.Destination.Branch.Name, merged.State)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// Modes of `sticky_comment`, keeping a single comment per job on the pull request.
+const (
+	stickyEdit     = "edit"
+	stickyRecreate = "recreate"
+)
+
+// commentText returns the raw comment configured with `comment` or `comment_file`, the latter being relative
+// to the input directory.
+func commentText(inputDir string, params models.Params) (string, error) {
+	if params.Comment != "" && params.CommentFile != "" {
+		return "", errors.New("only one of comment or comment_file may be provided")
+	}
+	if params.CommentFile == "" {
+		return params.Comment, nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(inputDir, params.CommentFile))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read comment_file %q", params.CommentFile)
+	}
+	return string(content), nil
+}
+
+// publishComment posts the rendered comment on the pull request and returns its link. Sticky comments carry
+// a hidden marker identifying the job, through which the comment of a previous build is edited, re-created or,
+// once the build succeeds, deleted. An empty link means no comment is left on the pull request.
+func publishComment(ctx context.Context, client *bitbucket.Client, params models.Params, pr models.GenericResponse, text string, succeeded bool) (string, error) {
+	if params.StickyComment != "" && params.StickyComment != stickyEdit && params.StickyComment != stickyRecreate {
+		return "", errors.Errorf("unknown sticky_comment %q, must be one of %q or %q", params.StickyComment, stickyEdit, stickyRecreate)
+	}
+
+	if params.StickyComment == "" && !params.DeleteCommentOnSuccess {
+		posted, err := client.CreateComment(ctx, pr, text)
+		if err != nil {
+			return "", err
+		}
+		return posted.Link, nil
+	}
+
+	marker := stickyMarker()
+	comments, err := client.GetPrComments(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+	var previous *models.Comment
+	for i := range comments {
+		if strings.Contains(comments[i].Content.Raw, marker) {
+			previous = &comments[i]
+		}
+	}
+
+	if succeeded && params.DeleteCommentOnSuccess {
+		if previous != nil {
+			log.Printf("Deleting comment %s", previous.Link)
+			return "", client.DeleteComment(ctx, pr, *previous)
+		}
+		return "", nil
+	}
+	if text == "" {
+		return "", nil
+	}
+
+	text = marker + "\n\n" + text
+	if previous != nil && params.StickyComment == stickyEdit {
+		updated, err := client.UpdateComment(ctx, pr, *previous, text)
+		if err != nil {
+			return "", err
+		}
+		return updated.Link, nil
+	}
+	if previous != nil {
+		if err := client.DeleteComment(ctx, pr, *previous); err != nil {
+			return "", err
+		}
+	}
+	posted, err := client.CreateComment(ctx, pr, text)
+	if err != nil {
+		return "", err
+	}
+	return posted.Link, nil
+}
+
+// stickyMarker identifies the comments of the current job. It is an empty Markdown link reference,
+// which neither Bitbucket Cloud nor Server render.
+func stickyMarker() string {
+	return fmt.Sprintf("[//]: # (concourse-bitbucket-pullrequest-resource %s/%s/%s)",
+		os.Getenv("BUILD_TEAM_NAME"), os.Getenv("BUILD_PIPELINE_NAME"), os.Getenv("BUILD_JOB_NAME"))
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// Ways of reporting findings, selected with `mode`.
+const (
+	findingsAnnotations = "annotations"
+	findingsComments    = "comments"
+)
+
+// severities ranks the Code Insights severities, from least to most severe.
+var severities = []string{"LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// findingsParser turns the report of a static analysis tool into annotations.
+type findingsParser func(content []byte) ([]models.Annotation, error)
+
+// findingsParsers holds the supported report formats by name.
+var findingsParsers = map[string]findingsParser{
+	"sarif":      parseSARIF,
+	"checkstyle": parseCheckstyle,
+}
+
+// readFindings parses every report matching the glob of params, detecting the format of each unless one is configured.
+func readFindings(inputDir string, params models.FindingsParams) ([]models.Annotation, error) {
+	files, err := filepath.Glob(filepath.Join(inputDir, params.Files))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid findings pattern %q", params.Files)
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("no findings reports match %q", params.Files)
+	}
+
+	var findings []models.Annotation
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read findings report %q", file)
+		}
+
+		format := strings.ToLower(params.Format)
+		if format == "" {
+			format = "checkstyle"
+			if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+				format = "sarif"
+			}
+		}
+		parse, ok := findingsParsers[format]
+		if !ok {
+			return nil, errors.Errorf("unknown findings format %q, must be one of %q or %q", format, "sarif", "checkstyle")
+		}
+
+		parsed, err := parse(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse findings report %q", file)
+		}
+		for i := range parsed {
+			parsed[i].Path = strings.TrimPrefix(strings.TrimPrefix(parsed[i].Path, params.StripPrefix), "/")
+		}
+		findings = append(findings, parsed...)
+	}
+	return findings, nil
+}
+
+// publishFindings reports the findings either as a Code Insights report on the commit, failed when a finding
+// reaches the severity threshold, or as inline comments on the pull request. Comments already made on the same
+// line are not repeated. It returns the report key, or the number of comments posted.
+func publishFindings(ctx context.Context, client *bitbucket.Client, inputDir string, request models.OutRequest, commit string) (string, error) {
+	params := *request.Params.Findings
+	findings, err := readFindings(inputDir, params)
+	if err != nil {
+		return "", err
+	}
+
+	threshold := strings.ToUpper(params.Threshold)
+	if threshold == "" {
+		threshold = "HIGH"
+	}
+	if severityRank(threshold) < 0 {
+		return "", errors.Errorf("unknown threshold %q, must be one of %s", params.Threshold, strings.Join(severities, ", "))
+	}
+
+	switch params.Mode {
+	case "", findingsAnnotations:
+		key := params.Key
+		if key == "" {
+			key = bitbucket.StatusKeyPrefix + os.Getenv("BUILD_JOB_NAME") + "-findings"
+		}
+		report := models.Report{
+			Title:      params.Title,
+			Details:    fmt.Sprintf("%d findings", len(findings)),
+			ReportType: "BUG",
+			Reporter:   "Concourse",
+			Result:     "PASSED",
+		}
+		if report.Title == "" {
+			report.Title = "Static analysis"
+		}
+		if request.Source.ConcourseURL != "" {
+			report.Link = bitbucket.BuildURL(request.Source.ConcourseURL)
+		}
+		// Findings below the threshold are listed as passed, so they do not show up as failures.
+		for i, finding := range findings {
+			findings[i].Result = "PASSED"
+			if severityRank(finding.Severity) >= severityRank(threshold) {
+				findings[i].Result = "FAILED"
+				report.Result = "FAILED"
+			}
+		}
+		return key, client.PublishReport(ctx, commit, key, report, findings)
+
+	case findingsComments:
+		prID, err := pullRequestID(inputDir, request.Params)
+		if err != nil {
+			return "", err
+		}
+		pr, err := client.GetPullRequestByID(ctx, prID)
+		if err != nil {
+			return "", err
+		}
+		existing, err := client.GetInlineComments(ctx, *pr)
+		if err != nil {
+			return "", err
+		}
+
+		posted := 0
+		for _, finding := range findings {
+			text := findingComment(finding)
+			if commented(existing, finding, text) {
+				continue
+			}
+			// Lines outside of the diff cannot always be commented on, which should not fail the build.
+			if _, err := client.CreateInlineComment(ctx, *pr, finding.Path, finding.Line, text); err != nil {
+				log.Printf("Unable to comment on %s:%d: %v", finding.Path, finding.Line, err)
+				continue
+			}
+			posted++
+		}
+		return strconv.Itoa(posted) + " comments", nil
+	}
+	return "", errors.Errorf("unknown findings mode %q, must be one of %q or %q", params.Mode, findingsAnnotations, findingsComments)
+}
+
+func severityRank(severity string) int {
+	for i, known := range severities {
+		if strings.EqualFold(severity, known) {
+			return i
+		}
+	}
+	return -1
+}
+
+func findingComment(finding models.Annotation) string {
+	text := "**" + finding.Severity + "** " + finding.Summary
+	if finding.Details != "" {
+		text += "\n\n" + finding.Details
+	}
+	if finding.Link != "" {
+		text += "\n\n" + finding.Link
+	}
+	return text
+}
+
+func commented(comments []models.Comment, finding models.Annotation, text string) bool {
+	for _, comment := range comments {
+		if comment.Inline.Path == finding.Path && comment.Inline.To == finding.Line && strings.TrimSpace(comment.Content.Raw) == text {
+			return true
+		}
+	}
+	return false
+}
+
+// sarifLog is the subset of a SARIF 2.1 log needed to locate and rank results.
+// <https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html>
+type sarifLog struct {
+	Runs []struct {
+		Tool struct {
+			Driver struct {
+				Name  string      `json:"name"`
+				Rules []sarifRule `json:"rules"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleID    string `json:"ruleId"`
+			RuleIndex *int   `json:"ruleIndex"`
+			Level     string `json:"level"`
+			Message   struct {
+				Text string `json:"text"`
+			} `json:"message"`
+			Locations []struct {
+				PhysicalLocation struct {
+					ArtifactLocation struct {
+						URI string `json:"uri"`
+					} `json:"artifactLocation"`
+					Region struct {
+						StartLine int `json:"startLine"`
+					} `json:"region"`
+				} `json:"physicalLocation"`
+			} `json:"locations"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+type sarifRule struct {
+	ID               string `json:"id"`
+	HelpURI          string `json:"helpUri"`
+	ShortDescription struct {
+		Text string `json:"text"`
+	} `json:"shortDescription"`
+	DefaultConfiguration struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+	Properties struct {
+		SecuritySeverity string `json:"security-severity"`
+	} `json:"properties"`
+}
+
+func parseSARIF(content []byte) ([]models.Annotation, error) {
+	var report sarifLog
+	if err := json.Unmarshal(content, &report); err != nil {
+		return nil, err
+	}
+
+	var annotations []models.Annotation
+	for _, run := range report.Runs {
+		rules := map[string]sarifRule{}
+		for _, rule := range run.Tool.Driver.Rules {
+			rules[rule.ID] = rule
+		}
+
+		for _, result := range run.Results {
+			rule, ok := rules[result.RuleID]
+			if !ok && result.RuleIndex != nil && *result.RuleIndex < len(run.Tool.Driver.Rules) {
+				rule = run.Tool.Driver.Rules[*result.RuleIndex]
+			}
+			level := result.Level
+			if level == "" {
+				level = rule.DefaultConfiguration.Level
+			}
+
+			annotation := models.Annotation{
+				AnnotationType: "CODE_SMELL",
+				Summary:        truncate(strings.TrimSpace(run.Tool.Driver.Name+" "+result.RuleID+": "+result.Message.Text), maxSummaryLength),
+				Details:        truncate(rule.ShortDescription.Text, maxDetailsLength),
+				Severity:       sarifSeverity(level, rule.Properties.SecuritySeverity),
+				Link:           rule.HelpURI,
+			}
+			if rule.Properties.SecuritySeverity != "" {
+				annotation.AnnotationType = "VULNERABILITY"
+			}
+			if len(result.Locations) > 0 {
+				location := result.Locations[0].PhysicalLocation
+				annotation.Path = strings.TrimPrefix(location.ArtifactLocation.URI, "file://")
+				annotation.Line = location.Region.StartLine
+			}
+			annotations = append(annotations, annotation)
+		}
+	}
+	return annotations, nil
+}
+
+// sarifSeverity ranks a result by its CVSS like security severity when the tool provides one, as gosec and
+// semgrep do, and by its level otherwise.
+func sarifSeverity(level, securitySeverity string) string {
+	if score, err := strconv.ParseFloat(securitySeverity, 64); err == nil {
+		switch {
+		case score >= 9:
+			return "CRITICAL"
+		case score >= 7:
+			return "HIGH"
+		case score >= 4:
+			return "MEDIUM"
+		}
+		return "LOW"
+	}
+	switch level {
+	case "error":
+		return "HIGH"
+	case "", "warning":
+		return "MEDIUM"
+	}
+	return "LOW"
+}
+
+// checkstyleReport is the checkstyle XML format, as written by golangci-lint and many other linters.
+type checkstyleReport struct {
+	Files []struct {
+		Name   string `xml:"name,attr"`
+		Errors []struct {
+			Line     int    `xml:"line,attr"`
+			Severity string `xml:"severity,attr"`
+			Message  string `xml:"message,attr"`
+			Source   string `xml:"source,attr"`
+		} `xml:"error"`
+	} `xml:"file"`
+}
+
+func parseCheckstyle(content []byte) ([]models.Annotation, error) {
+	var report checkstyleReport
+	if err := xml.Unmarshal(content, &report); err != nil {
+		return nil, err
+	}
+
+	var annotations []models.Annotation
+	for _, file := range report.Files {
+		for _, finding := range file.Errors {
+			severity := "LOW"
+			switch finding.Severity {
+			case "error":
+				severity = "HIGH"
+			case "warning":
+				severity = "MEDIUM"
+			}
+			summary := finding.Message
+			if finding.Source != "" {
+				summary = finding.Source + ": " + summary
+			}
+			annotations = append(annotations, models.Annotation{
+				AnnotationType: "CODE_SMELL",
+				Path:           file.Name,
+				Line:           finding.Line,
+				Summary:        truncate(summary, maxSummaryLength),
+				Severity:       severity,
+			})
+		}
+	}
+	return annotations, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+func TestParseSARIF(t *testing.T) {
+	content := []byte(`{
+  "version": "2.1.0",
+  "runs": [{
+    "tool": {"driver": {"name": "gosec", "rules": [
+      {"id": "G101", "helpUri": "https://example.com/G101", "shortDescription": {"text": "Hardcoded credentials"},
+       "properties": {"security-severity": "9.1"}},
+      {"id": "G104", "shortDescription": {"text": "Unhandled error"}, "defaultConfiguration": {"level": "note"}}
+    ]}},
+    "results": [
+      {"ruleId": "G101", "level": "warning", "message": {"text": "Potential credentials"},
+       "locations": [{"physicalLocation": {"artifactLocation": {"uri": "file://cmd/main.go"}, "region": {"startLine": 12}}}]},
+      {"ruleId": "other", "ruleIndex": 1, "message": {"text": "Errors unhandled"},
+       "locations": [{"physicalLocation": {"artifactLocation": {"uri": "cmd/client.go"}, "region": {"startLine": 3}}}]},
+      {"ruleId": "G999", "level": "error", "message": {"text": "No location"}}
+    ]
+  }]
+}`)
+
+	want := []models.Annotation{
+		{
+			AnnotationType: "VULNERABILITY",
+			Path:           "cmd/main.go",
+			Line:           12,
+			Summary:        "gosec G101: Potential credentials",
+			Details:        "Hardcoded credentials",
+			Severity:       "CRITICAL",
+			Link:           "https://example.com/G101",
+		},
+		{
+			AnnotationType: "CODE_SMELL",
+			Path:           "cmd/client.go",
+			Line:           3,
+			Summary:        "gosec other: Errors unhandled",
+			Details:        "Unhandled error",
+			Severity:       "LOW",
+		},
+		{
+			AnnotationType: "CODE_SMELL",
+			Summary:        "gosec G999: No location",
+			Severity:       "HIGH",
+		},
+	}
+
+	got, err := parseSARIF(content)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := parseSARIF([]byte(`{"runs": [`)); err == nil {
+		t.Error("expected an error for an invalid report")
+	}
+}
+
+func TestSARIFSeverity(t *testing.T) {
+	tests := []struct {
+		level, securitySeverity string
+		want                    string
+	}{
+		{level: "note", securitySeverity: "9.0", want: "CRITICAL"},
+		{level: "note", securitySeverity: "7.5", want: "HIGH"},
+		{level: "error", securitySeverity: "4", want: "MEDIUM"},
+		{level: "error", securitySeverity: "0.5", want: "LOW"},
+		{level: "error", want: "HIGH"},
+		{level: "warning", want: "MEDIUM"},
+		{level: "", want: "MEDIUM"},
+		{level: "note", want: "LOW"},
+		{level: "none", securitySeverity: "high", want: "LOW"},
+	}
+	for _, test := range tests {
+		if got := sarifSeverity(test.level, test.securitySeverity); got != test.want {
+			t.Errorf("sarifSeverity(%q, %q) = %q, want %q", test.level, test.securitySeverity, got, test.want)
+		}
+	}
+}
+
+func TestParseCheckstyle(t *testing.T) {
+	content := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<checkstyle version="5.0">
+  <file name="cmd/check/main.go">
+    <error line="10" column="2" severity="error" message="ineffectual assignment to err" source="ineffassign"></error>
+    <error line="20" severity="warning" message="exported function should have comment"></error>
+  </file>
+  <file name="cmd/out/main.go">
+    <error line="5" severity="info" message="line is too long" source="lll"></error>
+  </file>
+  <file name="cmd/in/main.go"></file>
+</checkstyle>`)
+
+	want := []models.Annotation{
+		{AnnotationType: "CODE_SMELL", Path: "cmd/check/main.go", Line: 10, Summary: "ineffassign: ineffectual assignment to err", Severity: "HIGH"},
+		{AnnotationType: "CODE_SMELL", Path: "cmd/check/main.go", Line: 20, Summary: "exported function should have comment", Severity: "MEDIUM"},
+		{AnnotationType: "CODE_SMELL", Path: "cmd/out/main.go", Line: 5, Summary: "lll: line is too long", Severity: "LOW"},
+	}
+
+	got, err := parseCheckstyle(content)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := parseCheckstyle([]byte(`<checkstyle><file>`)); err == nil {
+		t.Error("expected an error for an invalid report")
+	}
+}
+
+func TestSeverityRank(t *testing.T) {
+	if severityRank("low") >= severityRank("MEDIUM") || severityRank("HIGH") >= severityRank("critical") {
+		t.Error("severities are not ranked from LOW to CRITICAL")
+	}
+	if severityRank("BLOCKER") != -1 {
+		t.Error("unknown severity is ranked")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// Bitbucket truncates or rejects longer annotation texts.
+const (
+	maxSummaryLength = 450
+	maxDetailsLength = 2000
+)
+
+// junitSuite is a <testsuite> element. Suites may be nested, and usually come wrapped in <testsuites>.
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	File      string        `xml:"file,attr"`
+	Line      int           `xml:"line,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// testResults sums up the test cases of a set of JUnit reports.
+type testResults struct {
+	Passed, Failed, Skipped int
+	// Duration is in milliseconds, as Code Insights expects it.
+	Duration int64
+	Failures []models.Annotation
+}
+
+// Summary describes the results the way build statuses show them, e.g. "123 passed, 2 failed".
+func (r testResults) Summary() string {
+	summary := fmt.Sprintf("%d passed, %d failed", r.Passed, r.Failed)
+	if r.Skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", r.Skipped)
+	}
+	return summary
+}
+
+// Data returns the figures shown on the Code Insights report.
+func (r testResults) Data() []models.ReportData {
+	return []models.ReportData{
+		{Title: "Passed", Type: "NUMBER", Value: r.Passed},
+		{Title: "Failed", Type: "NUMBER", Value: r.Failed},
+		{Title: "Skipped", Type: "NUMBER", Value: r.Skipped},
+		{Title: "Duration", Type: "DURATION", Value: r.Duration},
+	}
+}
+
+// readJUnit parses every JUnit XML file matching pattern, relative to the input directory.
+func readJUnit(inputDir, pattern string) (*testResults, error) {
+	files, err := filepath.Glob(filepath.Join(inputDir, pattern))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid junit pattern %q", pattern)
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("no JUnit reports match %q", pattern)
+	}
+
+	results := &testResults{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read JUnit report %q", file)
+		}
+		// Whether the root is <testsuites> or a single <testsuite>, it decodes as a suite.
+		var root junitSuite
+		if err := xml.Unmarshal(content, &root); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse JUnit report %q", file)
+		}
+		results.add(root)
+	}
+	return results, nil
+}
+
+func (r *testResults) add(suite junitSuite) {
+	for _, nested := range suite.Suites {
+		r.add(nested)
+	}
+	for _, test := range suite.Cases {
+		r.Duration += int64(test.Time * 1000)
+
+		failure := test.Failure
+		if failure == nil {
+			failure = test.Error
+		}
+		switch {
+		case failure != nil:
+			r.Failed++
+			r.Failures = append(r.Failures, failureAnnotation(suite, test, *failure))
+		case test.Skipped != nil:
+			r.Skipped++
+		default:
+			r.Passed++
+		}
+	}
+}
+
+func failureAnnotation(suite junitSuite, test junitCase, failure junitFailure) models.Annotation {
+	name := test.Name
+	if test.ClassName != "" {
+		name = test.ClassName + "." + name
+	} else if suite.Name != "" {
+		name = suite.Name + "." + name
+	}
+
+	summary := name + " failed"
+	if message := strings.TrimSpace(failure.Message); message != "" {
+		summary += ": " + message
+	}
+
+	return models.Annotation{
+		AnnotationType: "BUG",
+		Path:           test.File,
+		Line:           test.Line,
+		Summary:        truncate(summary, maxSummaryLength),
+		Details:        truncate(strings.TrimSpace(failure.Text), maxDetailsLength),
+		Severity:       "HIGH",
+		Result:         "FAILED",
+	}
+}
+
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "…"
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+func writeReports(t *testing.T, reports map[string]string) string {
+	dir, err := ioutil.TempDir("", "junit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range reports {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadJUnit(t *testing.T) {
+	dir := writeReports(t, map[string]string{
+		"results/unit.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="client">
+    <testcase name="TestRetry" classname="bitbucket" time="1.5"></testcase>
+    <testcase name="TestTimeout" classname="bitbucket" time="0.25" file="cmd/bitbucket/client_test.go" line="42">
+      <failure message=" timed out " type="assert">  client_test.go:42: expected a timeout  </failure>
+    </testcase>
+    <testsuite name="nested">
+      <testcase name="TestSkipped" time="0"><skipped/></testcase>
+      <testcase name="TestPanics" time="0.001"><error message="panic">stack</error></testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>`,
+		"results/integration.xml": `<testsuite name="integration">
+  <testcase name="TestCheck" time="2"></testcase>
+</testsuite>`,
+		"results/ignored.txt": `not a report`,
+	})
+	defer os.RemoveAll(dir)
+
+	results, err := readJUnit(dir, "results/*.xml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if results.Passed != 2 || results.Failed != 2 || results.Skipped != 1 {
+		t.Errorf("got %d passed, %d failed and %d skipped, want 2, 2 and 1", results.Passed, results.Failed, results.Skipped)
+	}
+	if results.Duration != 3751 {
+		t.Errorf("got a duration of %dms, want 3751ms", results.Duration)
+	}
+	if summary := results.Summary(); summary != "2 passed, 2 failed, 1 skipped" {
+		t.Errorf("got summary %q", summary)
+	}
+
+	want := []models.Annotation{
+		// Nested suites are read before the test cases next to them.
+		{
+			AnnotationType: "BUG",
+			Summary:        "nested.TestPanics failed: panic",
+			Details:        "stack",
+			Severity:       "HIGH",
+			Result:         "FAILED",
+		},
+		{
+			AnnotationType: "BUG",
+			Path:           "cmd/bitbucket/client_test.go",
+			Line:           42,
+			Summary:        "bitbucket.TestTimeout failed: timed out",
+			Details:        "client_test.go:42: expected a timeout",
+			Severity:       "HIGH",
+			Result:         "FAILED",
+		},
+	}
+	if !reflect.DeepEqual(results.Failures, want) {
+		t.Errorf("got failures %+v, want %+v", results.Failures, want)
+	}
+}
+
+func TestReadJUnitErrors(t *testing.T) {
+	dir := writeReports(t, map[string]string{
+		"broken.xml": `<testsuite><testcase>`,
+	})
+	defer os.RemoveAll(dir)
+
+	if _, err := readJUnit(dir, "missing/*.xml"); err == nil || !strings.Contains(err.Error(), "no JUnit reports match") {
+		t.Errorf("expected an error when no report matches, got %v", err)
+	}
+	if _, err := readJUnit(dir, "*.xml"); err == nil || !strings.Contains(err.Error(), "unable to parse JUnit report") {
+		t.Errorf("expected an error for an invalid report, got %v", err)
+	}
+	if _, err := readJUnit(dir, "[.xml"); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		text   string
+		length int
+		want   string
+	}{
+		{text: "short", length: 10, want: "short"},
+		{text: "exactly", length: 7, want: "exactly"},
+		{text: "truncated", length: 5, want: "trun…"},
+		{text: "ééééé", length: 3, want: "éé…"},
+	}
+	for _, test := range tests {
+		if got := truncate(test.text, test.length); got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.text, test.length, got, test.want)
+		}
+	}
+}
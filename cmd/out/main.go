@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/pkg/errors"
+
 	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
 	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
 )
@@ -21,7 +25,12 @@ func main() {
 	args := os.Args
 	inputDir := args[1]
 
-	token, err := bitbucket.RequestToken(request.Source.Key, request.Source.Secret)
+	timeout, err := bitbucket.Timeout(request.Source)
+	check(err)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client, err := bitbucket.NewClient(ctx, request.Source)
 	check(err)
 
 	Commit, err := ioutil.ReadFile(inputDir + "/" + request.Params.Commit)
@@ -29,16 +38,46 @@ func main() {
 
 	UpdateCommit := string(Commit)
 	UpdateCommit = strings.TrimSpace(UpdateCommit)
-	switch state := request.Params.State; state {
-	case "success":
-		err = bitbucket.SetBuildStatus(request.Source.URL, token, request.Source.APIVersion, request.Source.Team, request.Source.Repo, UpdateCommit, "SUCCESSFUL", request.Source.ConcourseURL)
+
+	comment, err := commentText(inputDir, request.Params)
+	check(err)
+
+	var tests *testResults
+	var summary string
+	if request.Params.JUnit != "" {
+		tests, err = readJUnit(inputDir, request.Params.JUnit)
+		check(err)
+		summary = tests.Summary()
+		log.Print(summary)
+	}
+
+	// The pull request is only fetched when something needs it, and then only once.
+	var pr *models.GenericResponse
+	pullRequest := func() models.GenericResponse {
+		if pr == nil {
+			prID, err := pullRequestID(inputDir, request.Params)
+			check(err)
+			pr, err = client.GetPullRequestByID(ctx, prID)
+			check(err)
+		}
+		return *pr
+	}
+
+	if request.Params.State != "" {
+		state, err := parseState(request.Params.State)
 		check(err)
-		log.Print(UpdateCommit)
-	case "failed":
-		err = bitbucket.SetBuildStatus(request.Source.URL, token, request.Source.APIVersion, request.Source.Team, request.Source.Repo, UpdateCommit, "FAILED", request.Source.ConcourseURL)
+
+		var current models.GenericResponse
+		if statusTemplated(request.Params) {
+			current = pullRequest()
+		}
+		status, err := buildStatus(request, current, state, summary)
+		check(err)
+
+		err = client.SetBuildStatus(ctx, UpdateCommit, status)
 		check(err)
-		log.Print(UpdateCommit)
-	default:
+		log.Printf("%s: %s", UpdateCommit, status.State)
+	} else if comment == "" && request.Params.Action == "" && request.Params.Report == nil && tests == nil && request.Params.Findings == nil {
 		log.Fatal("No Status Set")
 	}
 
@@ -46,9 +85,64 @@ func main() {
 
 	metadata := models.Metadata{version}
 
+	if request.Params.Report != nil || tests != nil {
+		key, err := publishReport(ctx, client, inputDir, request, UpdateCommit, tests)
+		check(err)
+		log.Printf("Published report %s on %s", key, UpdateCommit)
+
+		metadata = append(metadata, models.MetadataField{Name: "Report", Value: key})
+	}
+
+	if request.Params.Findings != nil {
+		published, err := publishFindings(ctx, client, inputDir, request, UpdateCommit)
+		check(err)
+		log.Printf("Published findings on %s: %s", UpdateCommit, published)
+
+		metadata = append(metadata, models.MetadataField{Name: "Findings", Value: published})
+	}
+
+	succeeded := request.Params.State != "" && states[strings.ToLower(request.Params.State)].State == "SUCCESSFUL"
+	if comment != "" || (succeeded && request.Params.DeleteCommentOnSuccess) {
+		var text string
+		if comment != "" {
+			text, err = bitbucket.Render(comment, request.Source, pullRequest())
+			check(err)
+		}
+
+		link, err := publishComment(ctx, client, request.Params, pullRequest(), text, succeeded)
+		check(err)
+		if link != "" {
+			log.Printf("Commented on pull request #%d: %s", pr.ID, link)
+			metadata = append(metadata, models.MetadataField{Name: "Comment", Value: link})
+		}
+	}
+
+	if request.Params.Action != "" {
+		err = runAction(ctx, client, request, pullRequest(), UpdateCommit)
+		check(err)
+		log.Printf("Pull request #%d: %s", pr.ID, request.Params.Action)
+
+		metadata = append(metadata, models.MetadataField{Name: "Action", Value: request.Params.Action})
+	}
+
 	err = json.NewEncoder(os.Stdout).Encode(models.OutResponse{Version: request.Version, Metadata: metadata})
 	check(err)
 }
+
+// pullRequestID reads the pull request ID from the version file that in writes next to the commit file,
+// unless pull_request points to another file.
+func pullRequestID(inputDir string, params models.Params) (string, error) {
+	prFile := params.PullRequest
+	if prFile == "" {
+		prFile = filepath.Join(filepath.Dir(params.Commit), "version")
+	}
+	prID, err := ioutil.ReadFile(filepath.Join(inputDir, prFile))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read the pull request ID from %q", prFile)
+	}
+	return strings.TrimSpace(string(prID)), nil
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatalf("%+v", err)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// publishReport attaches the Code Insights report configured with `report` to the commit and returns its key.
+// The key, title, link and result default to the job, the build and the `state` param. Test results, when
+// given, turn it into a test report with a figure per outcome and an annotation per failing test.
+func publishReport(ctx context.Context, client *bitbucket.Client, inputDir string, request models.OutRequest, commit string, tests *testResults) (string, error) {
+	params := request.Params.Report
+	if params == nil {
+		params = &models.ReportParams{}
+	}
+	job := os.Getenv("BUILD_JOB_NAME")
+
+	key := params.Key
+	if key == "" {
+		key = bitbucket.StatusKeyPrefix + job
+	}
+
+	report := models.Report{
+		Title:      params.Title,
+		Details:    params.Details,
+		ReportType: strings.ToUpper(params.Type),
+		Reporter:   "Concourse",
+		Link:       params.Link,
+		Result:     strings.ToUpper(params.Result),
+		Data:       params.Data,
+	}
+	if report.Title == "" {
+		report.Title = job
+	}
+	if report.Link == "" && request.Source.ConcourseURL != "" {
+		report.Link = bitbucket.BuildURL(request.Source.ConcourseURL)
+	}
+	if report.Result == "" && request.Params.State != "" {
+		switch states[strings.ToLower(request.Params.State)].State {
+		case "SUCCESSFUL":
+			report.Result = "PASSED"
+		case "FAILED", "STOPPED":
+			report.Result = "FAILED"
+		case "INPROGRESS":
+			report.Result = "PENDING"
+		}
+	}
+
+	var annotations []models.Annotation
+	if params.Annotations != "" {
+		content, err := ioutil.ReadFile(filepath.Join(inputDir, params.Annotations))
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to read annotations %q", params.Annotations)
+		}
+		if err := json.Unmarshal(content, &annotations); err != nil {
+			return "", errors.Wrapf(err, "unable to parse annotations %q", params.Annotations)
+		}
+	}
+
+	if tests != nil {
+		if report.ReportType == "" {
+			report.ReportType = "TEST"
+		}
+		if report.Details == "" {
+			report.Details = tests.Summary()
+		}
+		if params.Result == "" {
+			report.Result = "PASSED"
+			if tests.Failed > 0 {
+				report.Result = "FAILED"
+			}
+		}
+		report.Data = append(report.Data, tests.Data()...)
+		annotations = append(annotations, tests.Failures...)
+	}
+	return key, client.PublishReport(ctx, commit, key, report, annotations)
+}
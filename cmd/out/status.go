@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/bitbucket"
+	"github.com/pickledrick/concourse-bitbucket-pullrequest-resource/cmd/models"
+)
+
+// buildState is a Bitbucket build status state, along with why the build ended up in it.
+type buildState struct {
+	State  string
+	Reason string
+}
+
+// states maps the `state` param, case insensitively, onto Bitbucket states. Besides the Bitbucket states
+// themselves it accepts the outcomes of Concourse steps, so on_abort and on_error hooks can report them.
+var states = map[string]buildState{
+	"success":     {"SUCCESSFUL", "Build succeeded"},
+	"successful":  {"SUCCESSFUL", "Build succeeded"},
+	"failed":      {"FAILED", "Build failed"},
+	"failure":     {"FAILED", "Build failed"},
+	"errored":     {"FAILED", "Build errored"},
+	"error":       {"FAILED", "Build errored"},
+	"inprogress":  {"INPROGRESS", "Build in progress"},
+	"in_progress": {"INPROGRESS", "Build in progress"},
+	"pending":     {"INPROGRESS", "Build in progress"},
+	"started":     {"INPROGRESS", "Build in progress"},
+	"stopped":     {"STOPPED", "Build stopped"},
+	"aborted":     {"STOPPED", "Build aborted"},
+}
+
+// parseState looks up the Bitbucket state of the `state` param.
+func parseState(state string) (buildState, error) {
+	parsed, ok := states[strings.ToLower(state)]
+	if !ok {
+		return buildState{}, errors.Errorf("unknown state %q, must be one of success, failed, errored, inprogress, stopped or aborted", state)
+	}
+	return parsed, nil
+}
+
+// statusTemplated reports whether the build status takes any field from params, which may refer to the pull request.
+func statusTemplated(params models.Params) bool {
+	return params.Key != "" || params.Name != "" || params.Description != "" || params.Refname != ""
+}
+
+// buildStatus renders the build status configured in params. The description defaults to summary, or to why the
+// build ended when there is none. The key and URL are left to SetBuildStatus when empty.
+func buildStatus(request models.OutRequest, pr models.GenericResponse, state buildState, summary string) (models.OutStatus, error) {
+	status := models.OutStatus{State: state.State}
+
+	fields := []struct {
+		template string
+		value    *string
+	}{
+		{request.Params.Key, &status.Key},
+		{request.Params.Name, &status.Name},
+		{request.Params.Description, &status.Description},
+		{request.Params.Refname, &status.Refname},
+	}
+	for _, field := range fields {
+		if field.template == "" {
+			continue
+		}
+		value, err := bitbucket.Render(field.template, request.Source, pr)
+		if err != nil {
+			return status, err
+		}
+		*field.value = value
+	}
+
+	if status.Description == "" {
+		status.Description = summary
+	}
+	if status.Description == "" {
+		status.Description = state.Reason
+	}
+	return status, nil
+}